@@ -0,0 +1,146 @@
+package clicache
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useBenchFolder points the cache at a fresh temporary folder for the duration of the benchmark.
+func useBenchFolder(b *testing.B) {
+	b.Helper()
+
+	fs = OSFileSystem{}
+	folder := cacheFolder
+	SetFolder(b.TempDir())
+	b.Cleanup(func() { SetFolder(folder) })
+}
+
+// seedEntries writes n cache entries with the given TTL.
+func seedEntries(b *testing.B, n int, ttl time.Duration) {
+	b.Helper()
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	for i := 0; i < n; i++ {
+		encoded, err := encodeCacheItem(newCacheItem(nil, "This is cached data.", ttl))
+		if err != nil {
+			b.Fatalf("Failed to encode cache item: %v", err)
+		}
+		file, err := fs.Create(getCacheFileName(HashArgs([]string{"seed", strconv.Itoa(i)})))
+		if err != nil {
+			b.Fatalf("Failed to create cache file: %v", err)
+		}
+		_, err = file.Write(encoded)
+		_ = file.Close()
+		if err != nil {
+			b.Fatalf("Failed to write cache file: %v", err)
+		}
+	}
+}
+
+func BenchmarkSet(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 5 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			useBenchFolder(b)
+			data := strings.Repeat("x", size)
+			args := []string{"command", "bench"}
+
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := Set(args, data, 60); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10, 5 << 20} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			useBenchFolder(b)
+			args := []string{"command", "bench"}
+			if err := Set(args, strings.Repeat("x", size), 60); err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, found, err := Get(args); !found || err != nil {
+					b.Fatalf("Get() found = %v, err = %v", found, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetMiss(b *testing.B) {
+	useBenchFolder(b)
+	seedEntries(b, 100, time.Minute)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, found, err := Get([]string{"command", "missing", strconv.Itoa(i)}); found || err != nil {
+			b.Fatalf("Get() found = %v, err = %v", found, err)
+		}
+	}
+}
+
+func BenchmarkCache(b *testing.B) {
+	// Cache keys on flag.Args, which is empty under go test.
+	SetAllowEmptyKey(true)
+	defer SetAllowEmptyKey(false)
+
+	handler := func() (string, error) {
+		return "This is data.", nil
+	}
+
+	b.Run("hit", func(b *testing.B) {
+		useBenchFolder(b)
+		if _, err := Cache(handler); err != nil {
+			b.Fatal(err)
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := Cache(handler); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("miss", func(b *testing.B) {
+		useBenchFolder(b)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			Cleanup()
+			b.StartTimer()
+			if _, err := Cache(handler); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGC(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			useBenchFolder(b)
+			seedEntries(b, n, time.Minute)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cacheMutex.Lock()
+				gc()
+				cacheMutex.Unlock()
+			}
+		})
+	}
+}
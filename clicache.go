@@ -1,18 +1,49 @@
 // Package clicache provides file-based caching tailored for CLI applications.
 // It allows CLI applications to cache data based on command arguments, and
 // supports TTL-based cache expiration.
+//
+// Most callers should start with GetOrSetContext, which returns the cached
+// value for the given arguments or computes and caches it on a miss:
+//
+//	out, err := clicache.GetOrSetContext(ctx, os.Args[1:], time.Minute,
+//	  func(ctx context.Context) (string, error) {
+//	    return fetch(ctx)
+//	  })
+//
+// Listings encode to a stable JSON shape, e.g. for a "cache ls --json" command:
+//
+//	entries, _, err := clicache.Scan(0, 100)
+//	if err != nil {
+//	  log.Fatalf("Failed to list cache: %v", err)
+//	}
+//	_ = json.NewEncoder(os.Stdout).Encode(entries)
 package clicache
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	iofs "io/fs"
+	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // FileSystem is an interface for file system operations.
@@ -23,6 +54,8 @@ type FileSystem interface {
 	Open(name string) (*os.File, error)
 	Remove(name string) error
 	IsNotExist(err error) bool
+	Glob(pattern string) ([]string, error)
+	Rename(oldpath, newpath string) error
 }
 
 // OSFileSystem is an implementation of FileSystem that uses the OS file system.
@@ -44,22 +77,278 @@ func (o OSFileSystem) IsNotExist(err error) bool {
 	return os.IsNotExist(err)
 }
 
+func (o OSFileSystem) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (o OSFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func init() {
+	// AppendToCache stores lists as []interface{}, which gob only encodes once registered.
+	gob.Register([]interface{}{})
+}
+
+var (
+	gobTypesMutex sync.Mutex
+	gobTypes      []string
+)
+
+// RegisterGobType registers the concrete type of v with gob, which is required before values of
+// that type can be cached through the untyped API: Get, Set and Cache store data as interface{}
+// values, and gob fails with "type not registered for interface" for unregistered types.
+// Registering a type more than once is safe. Builtin types don't need to be registered.
+//
+// v: Value of the type to register.
+//
+// Example:
+//
+//	type User struct {
+//	  Name string
+//	}
+//
+//	func init() {
+//	  clicache.RegisterGobType(User{})
+//	}
+func RegisterGobType(v interface{}) {
+	gob.Register(v)
+
+	gobTypesMutex.Lock()
+	defer gobTypesMutex.Unlock()
+
+	name := reflect.TypeOf(v).String()
+	for _, registered := range gobTypes {
+		if registered == name {
+			return
+		}
+	}
+	gobTypes = append(gobTypes, name)
+}
+
+// RegisteredGobTypes returns the names of the types registered with RegisterGobType, in
+// registration order.
+func RegisteredGobTypes() []string {
+	gobTypesMutex.Lock()
+	defer gobTypesMutex.Unlock()
+
+	return append([]string(nil), gobTypes...)
+}
+
 // fs is the file system used by clicache.
 var fs FileSystem = OSFileSystem{}
 
+// ConflictPolicy determines how Set handles an existing fresh entry for the same key.
+type ConflictPolicy int
+
+const (
+	// LastWriteWins overwrites existing entries. This is the default.
+	LastWriteWins ConflictPolicy = iota
+	// FirstWriteWins keeps an existing fresh entry and silently skips the write.
+	FirstWriteWins
+	// Reject keeps an existing fresh entry and returns ErrEntryExists.
+	Reject
+)
+
+// FileFingerprint determines how CacheForFile derives the cache key from the input file.
+type FileFingerprint int
+
+const (
+	// FingerprintContent hashes the file's contents. This is the default.
+	FingerprintContent FileFingerprint = iota
+	// FingerprintModTime uses the file's modification time and size, which avoids reading the file
+	// but misses changes that preserve both.
+	FingerprintModTime
+)
+
+// ErrRateLimited is returned by a rate-limited cache function when a cache miss exceeds the allowed rate.
+var ErrRateLimited = errors.New("clicache: handler invocation rate limited")
+
+// ErrChecksumMismatch is returned when a cache entry's data does not match its stored checksum.
+var ErrChecksumMismatch = errors.New("clicache: cache entry checksum mismatch")
+
+// ErrInvalidToken is returned by InvalidateToken when the token was not produced by SetToken.
+var ErrInvalidToken = errors.New("clicache: invalid invalidation token")
+
+// ErrInvalidPrefix is returned by CleanupDir and SweepForeignPrefixes when the cache file name prefix is empty or contains
+// path separators or glob metacharacters.
+var ErrInvalidPrefix = errors.New("clicache: invalid cache file name prefix")
+
+// ErrTxDone is returned by the methods of a Tx that has already been committed or rolled back.
+var ErrTxDone = errors.New("clicache: transaction has already been committed or rolled back")
+
+// ErrEntryExists is returned by Set when the Reject conflict policy is active and a fresh entry exists.
+var ErrEntryExists = errors.New("clicache: cache entry already exists")
+
+// ErrEntryNeverAppeared is returned by WaitForEntry when its context times out before the entry is cached.
+var ErrEntryNeverAppeared = errors.New("clicache: cache entry never appeared")
+
+// ErrEmptyKey is returned when a cache entry is read or written for nil or empty arguments, which
+// would otherwise all share a single entry. See SetAllowEmptyKey.
+var ErrEmptyKey = errors.New("clicache: empty cache key arguments")
+
+// ErrTypeMismatch is returned when a cache entry holds data of a different type than the operation expects,
+// e.g. by DecodeAs, GetOrCompute, GetOrSetContext, AppendToCache and IncrBy. The entry is left in place.
+var ErrTypeMismatch = errors.New("clicache: cached data has an unexpected type")
+
+// ErrUnsupportedFormat is returned when a cache entry was written in a newer format than FormatVersion.
+var ErrUnsupportedFormat = errors.New("clicache: cache entry has an unsupported format version")
+
+// SetFileSystem sets the file system used for all cache operations, e.g. a wrapper from the
+// clicachefs package that injects faults or latency. A nil fileSystem restores OSFileSystem.
+//
+// fileSystem: File system implementation.
+//
+// Example:
+//
+//	clicache.SetFileSystem(clicachefs.NewLatencyFS(clicache.OSFileSystem{}, 50*time.Millisecond))
+func SetFileSystem(fileSystem FileSystem) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if fileSystem == nil {
+		fileSystem = OSFileSystem{}
+	}
+	fs = fileSystem
+}
+
 // CacheItem represents a cached item with its expiration time and data.
 type CacheItem struct {
 	Expiration time.Time
 	Data       interface{}
+	Created    time.Time
+	Deps       []string
+	JSONData   []byte
+	Payload    []byte
+	Checksum   string
+	Provenance string
+	Args       []string
+	// Format is the format version the entry was written with, zero for entries written before
+	// format versions were recorded. See FormatVersion.
+	Format int
+}
+
+// formatVersion is the format version of the entries written by this build. Version 1 entries
+// may leave Data nil and keep the value in Payload or JSONData, see SetChecksum and SetJSONFallback.
+const formatVersion = 1
+
+// FormatVersion returns the format version of the cache entries written by this build. Entries
+// written in a newer format are not read; they are treated as corrupt and replaced.
+//
+// Returns the format version.
+//
+// Example:
+//
+//	fmt.Println("cache format:", clicache.FormatVersion())
+func FormatVersion() int {
+	return formatVersion
 }
 
+// maxAccessStatsKeys bounds the number of cache keys tracked by AccessStats.
+const maxAccessStatsKeys = 10000
+
 var (
 	cacheMutex  sync.Mutex
 	cachePrefix = "cli_cache_"
-	cacheTTL    = 300
+	keyPrefix   string
+	cacheTTL    = 300 * time.Second
 	cacheFolder = "/tmp/"
+	cacheMaxAge time.Duration
+
+	cacheDisabled bool
+
+	watchInterval = time.Second
+
+	tempSeq int
+
+	provenance string
+
+	embeddedFS  iofs.FS
+	embeddedDir string
+
+	conflictPolicy = LastWriteWins
+
+	jsonFallback    bool
+	checksumEnabled bool
+	storeArgs       bool
+
+	accessCounts = make(map[string]int)
+
+	keyLocksMutex sync.Mutex
+	keyLocks      = make(map[string]*keyLock)
+
+	argCanonicalizer func(arg string) string
+	keyPreprocessor  func(args []string) []string
+	keyEnv           []string
+	keyIgnoreFlags   map[string]bool
+	dataSanitizer    func(data interface{}) interface{}
+
+	ttlRules []TTLRule
+
+	lastGCStats GCStats
+
+	tracer Tracer
+
+	fileFingerprint FileFingerprint
+
+	allowEmptyKey bool
+
+	deprecationMutex    sync.Mutex
+	deprecationWarnings = true
+	deprecationsWarned  = make(map[string]bool)
 )
 
+// Tracer starts spans for cache operations. It is a minimal subset of tracing APIs such as
+// OpenTelemetry, so that clicache does not depend on one; wrap your tracer to implement it.
+type Tracer interface {
+	// StartSpan starts a span with the given name, e.g. "clicache.Get".
+	StartSpan(name string) Span
+}
+
+// Span is a single traced cache operation started by a Tracer.
+type Span interface {
+	// SetAttribute records an attribute such as "clicache.key" or "clicache.hit".
+	SetAttribute(key string, value interface{})
+	// End completes the span.
+	End()
+}
+
+// noopSpan is the Span used when no Tracer is set.
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(string, interface{}) {}
+func (noopSpan) End()                             {}
+
+// DefaultTTL can be passed to Set and every other function that stores an entry in place of a TTL to
+// use the TTL resolved by the rules set with SetTTLRules, or the default TTL set with SetTTLDuration if
+// no rule matches. Any negative TTL behaves the same, including negative durations passed to Modify,
+// AppendToCache and IncrBy.
+const DefaultTTL = -1
+
+// TTLRule supplies the TTL for cache entries whose arguments match it. A rule matches if the
+// arguments start with Prefix, or if the arguments joined by spaces match Glob (see path.Match).
+// An empty Prefix with an empty Glob matches nothing.
+type TTLRule struct {
+	Name   string
+	Prefix []string
+	Glob   string
+	TTL    time.Duration
+}
+
+// matches reports whether the rule applies to the given arguments.
+func (r TTLRule) matches(args []string) bool {
+	if len(r.Prefix) > 0 && hasArgsPrefix(args, r.Prefix) {
+		return true
+	}
+
+	if r.Glob != "" {
+		matched, err := path.Match(r.Glob, strings.Join(args, " "))
+		return err == nil && matched
+	}
+
+	return false
+}
+
 // SetTTL sets the default TTL for cache entries.
 //
 // ttl: Time to live in seconds for the cache entry.
@@ -67,197 +356,3459 @@ var (
 // Example:
 //
 //	clicache.SetTTL(60)  // 1 minute
+//
+// Deprecated: use SetTTLDuration. SetTTL logs a deprecation warning the first time it is called,
+// see SetDeprecationWarnings.
 func SetTTL(ttl int) {
-	cacheTTL = ttl
+	warnDeprecated("set-ttl", "clicache: SetTTL is deprecated, use SetTTLDuration")
+	SetTTLDuration(time.Duration(ttl) * time.Second)
 }
 
-// generateCacheKey produces a unique cache key based on the provided CLI arguments.
-// This ensures that different command invocations have distinct cache entries.
-func generateCacheKey(args []string) string {
-	joinedArgs := fmt.Sprintf("%v", args)
-	hash := sha256.Sum256([]byte(joinedArgs))
-	return hex.EncodeToString(hash[:])
-}
+// SetTTLDuration sets the default TTL for cache entries, used by Cache and by Set with DefaultTTL
+// when no rule set with SetTTLRules matches. The default is 5 minutes.
+//
+// d: Time to live for the cache entry.
+//
+// Example:
+//
+//	clicache.SetTTLDuration(time.Minute)
+func SetTTLDuration(d time.Duration) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
 
-// getCacheFileName constructs the cache file name for the given cache key.
-func getCacheFileName(cacheKey string) string {
-	return filepath.Join(cacheFolder, cachePrefix+fmt.Sprintf("%s.gob", cacheKey))
+	cacheTTL = d
 }
 
-// Cache is a helper function that retrieves the cached data associated with the provided CLI arguments.
-// If the cache entry is not found, the provided handler function is executed and its output is cached.
-// The data will expire after the specified TTL (in seconds).
-//
-// handler: Function that returns the data to be cached.
+// SetTTLRules sets the rules that resolve the TTL of entries stored with DefaultTTL. Rules are
+// evaluated in order and the first match wins. Passing nil removes all rules.
 //
-// Returns the cached data and an error if the operation fails.
+// rules: TTL rules in order of precedence.
 //
 // Example:
 //
-//	out, err := clicache.Cache(func() (string, error) {
-//	  return "This is data.", nil
+//	clicache.SetTTLRules([]clicache.TTLRule{
+//	  {Name: "releases", Prefix: []string{"releases"}, TTL: time.Hour},
+//	  {Name: "status", Glob: "* status", TTL: 10 * time.Second},
 //	})
-func Cache(handler func() (string, error)) (string, error) {
-	cached, isCached, err := Get(flag.Args())
-	if err != nil {
-		return "", err
-	}
-	if isCached {
-		return cached.(string), nil
-	}
-
-	out, err := handler()
-	if err != nil {
-		return "", err
-	}
-
-	err = Set(flag.Args(), out, cacheTTL)
-	if err != nil {
-		return "", err
-	}
+//	err := clicache.Set([]string{"releases", "list"}, data, clicache.DefaultTTL)
+func SetTTLRules(rules []TTLRule) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
 
-	return out, nil
+	ttlRules = append([]TTLRule(nil), rules...)
 }
 
-// Set stores the given data in the cache, associated with the provided CLI arguments.
-// The data will expire after the specified TTL (in seconds).
+// ResolveTTL reports the TTL that an entry stored with DefaultTTL for the provided CLI arguments
+// would get, and the name of the matching rule. The name is empty if no rule matched and the
+// default TTL applies.
 //
 // args: Command line arguments which determine the cache key.
-// data: Data to be cached.
-// ttl: Time to live in seconds for the cache entry.
-//
-// Returns an error if the operation fails.
 //
 // Example:
 //
-//	args := []string{"command", "arg1", "arg2"}
-//	data := "This is cached data."
-//	ttl := 60  // 1 minute
-//	err := clicache.Set(args, data, ttl)
-//	if err != nil {
-//	  log.Fatalf("Failed to set cache: %v", err)
-//	}
-func Set(args []string, data interface{}, ttl int) error {
+//	ttl, rule := clicache.ResolveTTL([]string{"releases", "list"})
+//	fmt.Printf("ttl %s from rule %q\n", ttl, rule)
+func ResolveTTL(args []string) (time.Duration, string) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
-	cacheKey := generateCacheKey(args)
-	cacheFile := getCacheFileName(cacheKey)
-	cacheItem := CacheItem{
-		Expiration: time.Now().Add(time.Duration(ttl) * time.Second),
-		Data:       data,
-	}
+	return resolveTTL(args)
+}
 
-	file, err := fs.Create(cacheFile)
-	if err != nil {
-		return err
+// resolveTTL returns the TTL and rule name for the provided CLI arguments.
+// The caller must hold cacheMutex.
+func resolveTTL(args []string) (time.Duration, string) {
+	for _, rule := range ttlRules {
+		if rule.matches(args) {
+			return rule.TTL, rule.Name
+		}
 	}
-	defer file.Close()
 
-	encoder := gob.NewEncoder(file)
-	err = encoder.Encode(&cacheItem)
-	if err != nil {
-		return err
-	}
+	return cacheTTL, ""
+}
 
-	gc() // Clean up expired cache entries.
+// SetAllowEmptyKey allows nil or empty arguments as a cache key. By default, operations on an entry
+// return ErrEmptyKey for such arguments, since all of them share one entry and unrelated call sites
+// would overwrite each other's data.
+//
+// allow: Whether to accept empty arguments.
+//
+// Example:
+//
+//	clicache.SetAllowEmptyKey(true)
+//	err := clicache.Set(nil, globalState, 60)
+func SetAllowEmptyKey(allow bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	allowEmptyKey = allow
+}
+
+// checkKeyArgs returns ErrEmptyKey if args are empty and empty keys are not allowed.
+// The caller must hold cacheMutex.
+func checkKeyArgs(args []string) error {
+	if len(args) == 0 && !allowEmptyKey {
+		return ErrEmptyKey
+	}
 
 	return nil
 }
 
-// Get retrieves the cached data associated with the provided CLI arguments.
+// SetFileFingerprint sets how CacheForFile fingerprints its input file.
 //
-// args: Command line arguments which determine the cache key.
+// fingerprint: FingerprintContent or FingerprintModTime.
 //
-// Returns the cached data, a boolean indicating if the cache entry was found, and an error if the operation fails.
+// Example:
+//
+//	clicache.SetFileFingerprint(clicache.FingerprintModTime)
+func SetFileFingerprint(fingerprint FileFingerprint) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	fileFingerprint = fingerprint
+}
+
+// SetTracer sets the tracer used to create a span for every Get, Set and Cache call. Spans record
+// the cache key as "clicache.key" and, for Get and Cache, whether the entry was found as
+// "clicache.hit". Spans may be started and ended while the cache lock is held, so the tracer must
+// not call clicache functions. Passing nil disables tracing, which is the default.
+//
+// t: Tracer to use.
 //
 // Example:
 //
-//	args := []string{"command", "arg1", "arg2"}
-//	data, found, err := clicache.Get(args)
-//	if err != nil {
-//	  log.Fatalf("Failed to get cache: %v", err)
-//	}
-//	if found {
-//	  fmt.Println("Cached data:", data)
-//	} else {
-//	  fmt.Println("Cache not found.")
-//	}
-func Get(args []string) (interface{}, bool, error) {
+//	clicache.SetTracer(otelTracerAdapter{tracer: otel.Tracer("mytool")})
+func SetTracer(t Tracer) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
-	cacheKey := generateCacheKey(args)
-	cacheFile := getCacheFileName(cacheKey)
+	tracer = t
+}
 
-	file, err := fs.Open(cacheFile)
-	if err != nil {
-		if fs.IsNotExist(err) {
-			return nil, false, nil
-		}
-		return nil, false, err
+// startSpan starts a span for the cache operation on the given key.
+// The caller must hold cacheMutex.
+func startSpan(name string, cacheKey string) Span {
+	if tracer == nil {
+		return noopSpan{}
 	}
-	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	var cacheItem CacheItem
-	err = decoder.Decode(&cacheItem)
+	span := tracer.StartSpan(name)
+	span.SetAttribute("clicache.key", cacheKey)
+	return span
+}
 
-	gc() // Clean up expired cache entries.
+// SetDeprecationWarnings enables or disables the warnings logged through log/slog the first time a
+// deprecated behavior is used. Warnings are enabled by default.
+//
+// enabled: Whether to log deprecation warnings.
+//
+// Example:
+//
+//	clicache.SetDeprecationWarnings(false)
+func SetDeprecationWarnings(enabled bool) {
+	deprecationMutex.Lock()
+	defer deprecationMutex.Unlock()
 
-	if err != nil || time.Now().After(cacheItem.Expiration) {
-		_ = fs.Remove(cacheFile)
-		return nil, false, nil
-	}
+	deprecationWarnings = enabled
+}
+
+// ResetDeprecationWarnings forgets which deprecation warnings were already logged, so that each is
+// logged again on its next use. It is mainly useful in tests.
+//
+// Example:
+//
+//	clicache.ResetDeprecationWarnings()
+func ResetDeprecationWarnings() {
+	deprecationMutex.Lock()
+	defer deprecationMutex.Unlock()
 
-	return cacheItem.Data, true, nil
+	deprecationsWarned = make(map[string]bool)
 }
 
-// gc scans the cache directory and removes outdated cache entries.
-// This ensures the cache stays lean and doesn't hoard expired data.
-func gc() {
-	files, err := filepath.Glob(cacheFolder + cachePrefix + "*.gob")
-	if err != nil {
+// warnDeprecated logs msg as a warning the first time it is called for the given deprecation ID
+// in this process, unless deprecation warnings are disabled.
+func warnDeprecated(id string, msg string) {
+	deprecationMutex.Lock()
+	if !deprecationWarnings || deprecationsWarned[id] {
+		deprecationMutex.Unlock()
 		return
 	}
+	deprecationsWarned[id] = true
+	deprecationMutex.Unlock()
 
-	for _, file := range files {
-		f, err := fs.Open(file)
-		if err != nil {
-			continue
-		}
-
-		decoder := gob.NewDecoder(f)
-		var cacheItem CacheItem
-		err = decoder.Decode(&cacheItem)
-		_ = f.Close()
-
-		if err != nil || time.Now().After(cacheItem.Expiration) {
-			_ = fs.Remove(file)
-		}
-	}
+	slog.Warn(msg, "deprecation", id)
 }
 
-// Cleanup removes all cache entries.
+// SetFolder sets the folder in which cache files are stored. The folder must exist.
+//
+// folder: Path of the cache folder.
 //
 // Example:
 //
-//	clicache.Cleanup()
-func Cleanup() {
+//	clicache.SetFolder(filepath.Join(os.TempDir(), "mytool"))
+func SetFolder(folder string) {
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
-	files, err := filepath.Glob(cacheFolder + cachePrefix + "*.gob")
+	cacheFolder = folder
+}
+
+// SwapFolder publishes the cache entries built in a staging folder into the configured cache folder,
+// replacing the previous generation: every staged entry is moved into the cache folder, then entries
+// of the previous generation that were not staged are removed. The cache folder itself stays the
+// same, so other processes and later runs see the new entries too, and shared folders such as the
+// default /tmp/ can be used. Each entry is moved with a rename, falling back to a copy if the staging
+// folder is on another device, so readers never see a partial entry. The swap as a whole is atomic
+// only for this process, which holds the cache lock throughout; other processes may briefly see a
+// mix of both generations. If moving an entry fails, the entries moved so far stay published, the
+// previous generation is kept, and the error is returned. The staging folder is removed once empty.
+//
+// stagingPath: Folder holding the new cache entries, written with the same prefix, e.g. by calling
+// SetFolder(stagingPath) before building them.
+//
+// Returns an error if stagingPath is not a directory or an entry cannot be published.
+//
+// Example:
+//
+//	staging, _ := os.MkdirTemp("", "mytool-cache-")
+//	// Build the new cache in staging...
+//	if err := clicache.SwapFolder(staging); err != nil {
+//	  log.Fatalf("Failed to swap cache folder: %v", err)
+//	}
+func SwapFolder(stagingPath string) error {
+	stat, err := os.Stat(stagingPath)
 	if err != nil {
-		return
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("clicache: %s is not a directory", stagingPath)
 	}
 
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	previous, err := getCacheFiles()
+	if err != nil {
+		return err
+	}
+	staged, err := fs.Glob(filepath.Join(stagingPath, cachePrefix+"*.gob"))
+	if err != nil {
+		return err
+	}
+
+	published := make(map[string]bool, len(staged))
+	for _, file := range staged {
+		target := filepath.Join(cacheFolder, filepath.Base(file))
+		if err := moveFile(file, target); err != nil {
+			return err
+		}
+		published[target] = true
+	}
+
+	for _, file := range previous {
+		if !published[file] {
+			_ = fs.Remove(file)
+		}
+	}
+	_ = os.Remove(stagingPath)
+
+	return nil
+}
+
+// moveFile renames src to dst. If they are on different devices, src is copied to a temporary file
+// next to dst, which is then renamed to dst, and src is removed. The caller must hold cacheMutex.
+func moveFile(src, dst string) error {
+	err := fs.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := tempFileName(dst)
+	out, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = fs.Remove(tmp)
+		return err
+	}
+
+	_ = fs.Remove(src)
+	return nil
+}
+
+// SetPrefix sets the prefix of cache file names. Entries written under a previous prefix are not
+// matched by Get, gc or Cleanup anymore; remove them with SweepForeignPrefixes.
+//
+// prefix: Cache file name prefix. The default is "cli_cache_".
+//
+// Example:
+//
+//	clicache.SetPrefix("mytool_v2_")
+func SetPrefix(prefix string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cachePrefix = prefix
+}
+
+// SetKeyPrefix sets a prefix that is placed before the hash in cache file names, producing names
+// like cli_cache_<prefix>_<hash>.gob, so the files of one command can be found at a glance.
+// Characters other than ASCII letters, digits, '-' and '_' are replaced with '-'. Entries written
+// under a different key prefix are not matched by Get anymore. An empty prefix restores the default.
+//
+// prefix: Key prefix, e.g. the name of the subcommand.
+//
+// Example:
+//
+//	clicache.SetKeyPrefix("status")
+//	// ls /tmp | grep cli_cache_status_
+func SetKeyPrefix(prefix string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	keyPrefix = sanitizeKeyPrefix(prefix)
+}
+
+// sanitizeKeyPrefix replaces the characters of prefix that are not allowed in key prefixes with '-'.
+func sanitizeKeyPrefix(prefix string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, prefix)
+}
+
+// SetDisabled disables or enables caching. While disabled, every lookup is a miss and nothing is
+// written, so helpers such as Cache always call their handler. This backs --no-cache style flags.
+//
+// disabled: Whether caching is disabled.
+//
+// Example:
+//
+//	clicache.SetDisabled(*noCache)
+func SetDisabled(disabled bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cacheDisabled = disabled
+}
+
+// ConfigureFromEnv configures the cache from environment variables named after the given prefix:
+//
+//   - <PREFIX>_CACHE_DIR: cache folder, created if it does not exist (see SetFolder)
+//   - <PREFIX>_CACHE_TTL: default TTL as a positive number of seconds (see SetTTLDuration)
+//   - <PREFIX>_CACHE_DISABLED: boolean disabling the cache, e.g. "1" or "true" (see SetDisabled)
+//
+// Unset variables leave the corresponding setting unchanged. All values are validated before the cache
+// folder is created, so no setting is changed and no folder is created if any value is malformed.
+//
+// prefix: Prefix of the environment variable names, e.g. "MYTOOL".
+//
+// Returns an error if a value is malformed or the cache folder cannot be created.
+//
+// Example:
+//
+//	if err := clicache.ConfigureFromEnv("MYTOOL"); err != nil {
+//	  log.Fatalf("Failed to configure cache: %v", err)
+//	}
+func ConfigureFromEnv(prefix string) error {
+	dirName := prefix + "_CACHE_DIR"
+	ttlName := prefix + "_CACHE_TTL"
+	disabledName := prefix + "_CACHE_DISABLED"
+
+	dir, hasDir := os.LookupEnv(dirName)
+
+	var ttl int
+	ttlValue, hasTTL := os.LookupEnv(ttlName)
+	if hasTTL {
+		var err error
+		ttl, err = strconv.Atoi(ttlValue)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("clicache: invalid %s: %q is not a positive integer", ttlName, ttlValue)
+		}
+	}
+
+	var disabled bool
+	disabledValue, hasDisabled := os.LookupEnv(disabledName)
+	if hasDisabled {
+		var err error
+		disabled, err = strconv.ParseBool(disabledValue)
+		if err != nil {
+			return fmt.Errorf("clicache: invalid %s: %w", disabledName, err)
+		}
+	}
+
+	if hasDir {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("clicache: invalid %s: %w", dirName, err)
+		}
+		SetFolder(dir)
+	}
+	if hasTTL {
+		SetTTLDuration(time.Duration(ttl) * time.Second)
+	}
+	if hasDisabled {
+		SetDisabled(disabled)
+	}
+
+	return nil
+}
+
+// SetProvenance sets a label recorded with every new entry to identify the code that produced it,
+// e.g. while a legacy and a new fetcher populate the same keys during a migration. It is reported
+// in EntryInfo and does not affect cache keys. Use SetWithProvenance to override it for one entry.
+//
+// p: Provenance label, e.g. "fetcher-v2". An empty label records nothing.
+//
+// Example:
+//
+//	clicache.SetProvenance("fetcher-v2")
+func SetProvenance(p string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	provenance = p
+}
+
+// SetEmbeddedFS sets a read-only layer consulted by Get when the cache folder has no entry, e.g. a
+// warm baseline cache shipped with the binary via embed.FS. Entries in the layer are named like
+// cache files in the cache folder, are never modified or removed, and are served until their stored
+// expiration. Set always writes to the cache folder. StreamList and Scan list the layer's entries
+// with EntryInfo.Embedded set. A nil fsys removes the layer.
+//
+// fsys: File system holding the baseline cache files.
+// dir: Directory within fsys containing the cache files.
+//
+// Example:
+//
+//	//go:embed cache
+//	var baseline embed.FS
+//
+//	clicache.SetEmbeddedFS(baseline, "cache")
+func SetEmbeddedFS(fsys iofs.FS, dir string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	embeddedFS = fsys
+	embeddedDir = dir
+}
+
+// readEmbeddedItem reads the cache item with the given key from the embedded layer.
+// It reports false if there is no embedded layer or no fresh entry in it.
+// The caller must hold cacheMutex.
+func readEmbeddedItem(cacheKey string) (CacheItem, bool) {
+	if embeddedFS == nil {
+		return CacheItem{}, false
+	}
+
+	file, err := embeddedFS.Open(path.Join(embeddedDir, cachePrefix+cacheKey+".gob"))
+	if err != nil {
+		return CacheItem{}, false
+	}
+	defer file.Close()
+
+	cacheItem, err := decodeCacheItem(file)
+	if err != nil || time.Now().After(cacheItem.Expiration) || exceedsMaxAge(cacheItem, time.Now()) {
+		return CacheItem{}, false
+	}
+
+	return cacheItem, true
+}
+
+// SetMaxAge sets a hard ceiling on the age of cache entries, independent of their TTL.
+// Entries created more than d ago are treated as a miss even if their TTL hasn't elapsed.
+// Entries written without a creation time are treated as too old. A zero d disables the ceiling.
+//
+// d: Maximum age of a cache entry.
+//
+// Example:
+//
+//	clicache.SetMaxAge(time.Hour)
+func SetMaxAge(d time.Duration) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cacheMaxAge = d
+}
+
+// exceedsMaxAge reports whether the cache item is older than the configured max age.
+func exceedsMaxAge(item CacheItem, now time.Time) bool {
+	return cacheMaxAge > 0 && (item.Created.IsZero() || now.Sub(item.Created) > cacheMaxAge)
+}
+
+// SetConflictPolicy sets how Set handles writes to a key that already holds a fresh entry.
+// Concurrent writers are serialized, so the policy decides which of them wins.
+//
+// policy: LastWriteWins (default), FirstWriteWins or Reject.
+//
+// Example:
+//
+//	clicache.SetConflictPolicy(clicache.FirstWriteWins)
+func SetConflictPolicy(policy ConflictPolicy) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	conflictPolicy = policy
+}
+
+// SetJSONFallback enables or disables storing data as JSON when gob cannot encode it, which is the
+// case for struct types that were not registered with gob.Register. Such data is read back as the
+// generic JSON shape rather than its original type: structs and maps become map[string]interface{},
+// slices become []interface{} and numbers become float64. Disabled by default.
+//
+// enabled: Whether to fall back to JSON encoding.
+//
+// Example:
+//
+//	clicache.SetJSONFallback(true)
+func SetJSONFallback(enabled bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	jsonFallback = enabled
+}
+
+// SetChecksum enables or disables storing a SHA-256 checksum of the encoded data with each new entry.
+// Entries with a checksum are verified when read, regardless of this setting. On a mismatch, caused
+// e.g. by bit rot or disk errors, the entry is removed and ErrChecksumMismatch is returned.
+// Only the data is covered, not the entry's metadata. Disabled by default.
+//
+// enabled: Whether to store checksums.
+//
+// Example:
+//
+//	clicache.SetChecksum(true)
+func SetChecksum(enabled bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	checksumEnabled = enabled
+}
+
+// SetStoreArgs enables or disables storing the CLI arguments in plain text with each new entry, which
+// Query needs to match entries by their arguments. The arguments are stored as passed, before
+// SetKeyIgnoreFlags or SetKeyPreprocessor strip anything from the key, so leave this disabled when
+// arguments may contain secrets. Disabled by default.
+//
+// enabled: Whether to store arguments.
+//
+// Example:
+//
+//	clicache.SetStoreArgs(true)
+func SetStoreArgs(enabled bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	storeArgs = enabled
+}
+
+// SetArgCanonicalizer sets a function applied to each CLI argument before the cache key is computed.
+// It allows callers to treat arguments that differ only in, e.g., case as the same cache entry.
+// Arguments are canonicalized before the key preprocessor set by SetKeyPreprocessor runs, so the
+// preprocessor sees canonical arguments. A nil fn restores the default behavior.
+//
+// fn: Function that returns the canonical form of an argument.
+//
+// Example:
+//
+//	clicache.SetArgCanonicalizer(strings.ToLower)
+func SetArgCanonicalizer(fn func(arg string) string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	argCanonicalizer = fn
+}
+
+// SetKeyIgnoreFlags sets flags that are stripped, together with their values, from the CLI arguments
+// before the cache key is computed. This is meant for flags that only affect presentation, such as
+// --color, so that invocations differing only in them share a cache entry.
+//
+// Flags are matched by their exact spelling, e.g. "--color", after SetArgCanonicalizer has been
+// applied and before SetKeyPreprocessor runs. The "--flag=value" form is always stripped as a whole.
+// The "--flag value" form is only recognized for flags declared to take a value, which then consume
+// the following argument whatever it is; other flags are stripped alone, so a positional argument
+// after them still contributes to the key. Arguments after a "--" terminator are never stripped.
+// Calling SetKeyIgnoreFlags with no flags restores the default behavior.
+//
+// flags: Flags to ignore, mapped to whether they take a value in the following argument, e.g.
+// map[string]bool{"--output-format": true, "--color": false}.
+//
+// Example:
+//
+//	clicache.SetKeyIgnoreFlags(map[string]bool{"--output-format": true, "--color": false})
+func SetKeyIgnoreFlags(flags map[string]bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	keyIgnoreFlags = make(map[string]bool, len(flags))
+	for flag, takesValue := range flags {
+		keyIgnoreFlags[flag] = takesValue
+	}
+}
+
+// stripIgnoredFlags returns args without the flags set by SetKeyIgnoreFlags and their values.
+func stripIgnoredFlags(args []string) []string {
+	stripped := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			stripped = append(stripped, args[i:]...)
+			break
+		}
+
+		name, _, hasValue := strings.Cut(arg, "=")
+		takesValue, ignored := keyIgnoreFlags[name]
+		if !ignored {
+			stripped = append(stripped, arg)
+			continue
+		}
+		if takesValue && !hasValue && i+1 < len(args) {
+			i++
+		}
+	}
+	return stripped
+}
+
+// SetKeyEnv sets environment variables whose values are mixed into every cache key, so that output
+// depending on, e.g., AWS_PROFILE is cached separately per profile. The variables are read each time
+// a key is computed. An unset variable yields a different key than one set to the empty string.
+// Values only contribute to the key hash and never appear in file names. Calling SetKeyEnv without
+// arguments restores the default behavior.
+//
+// names: Names of the environment variables.
+//
+// Example:
+//
+//	clicache.SetKeyEnv("AWS_PROFILE", "KUBECONFIG")
+func SetKeyEnv(names ...string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	keyEnv = append([]string(nil), names...)
+}
+
+// SetKeyPreprocessor sets a function applied to the CLI arguments before the cache key is computed.
+// It allows callers to normalize arguments, e.g. strip volatile flags such as request IDs.
+// A nil fn restores the default behavior.
+//
+// fn: Function that returns the normalized arguments.
+//
+// Example:
+//
+//	clicache.SetKeyPreprocessor(func(args []string) []string {
+//	  var out []string
+//	  for _, arg := range args {
+//	    if !strings.HasPrefix(arg, "--request-id=") {
+//	      out = append(out, arg)
+//	    }
+//	  }
+//	  return out
+//	})
+func SetKeyPreprocessor(fn func(args []string) []string) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	keyPreprocessor = fn
+}
+
+// SetDataSanitizer sets a function applied to the data before it is stored in the cache.
+// It allows callers to strip volatile fields so that stored entries are canonical.
+// A nil fn restores the default behavior.
+//
+// fn: Function that returns the sanitized data.
+//
+// Example:
+//
+//	clicache.SetDataSanitizer(func(data interface{}) interface{} {
+//	  if s, ok := data.(string); ok {
+//	    return strings.TrimSpace(s)
+//	  }
+//	  return data
+//	})
+func SetDataSanitizer(fn func(data interface{}) interface{}) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	dataSanitizer = fn
+}
+
+// generateCacheKey produces a unique cache key based on the provided CLI arguments.
+// This ensures that different command invocations have distinct cache entries.
+func generateCacheKey(args []string) string {
+	args = keyMaterial(args)
+	if keyPrefix != "" {
+		return keyPrefix + "_" + HashArgs(args)
+	}
+	return HashArgs(args)
+}
+
+// keyMaterial returns the arguments that are hashed into the cache key, after applying the
+// canonicalizer, ignored flags, preprocessor and environment variables.
+// The caller must hold cacheMutex.
+func keyMaterial(args []string) []string {
+	args = keyArgs(args)
+	if len(keyEnv) > 0 {
+		// NUL cannot occur in real command line arguments, so the
+		// environment material cannot collide with an argument.
+		args = append([]string(nil), args...)
+		for _, name := range keyEnv {
+			if value, ok := os.LookupEnv(name); ok {
+				args = append(args, "\x00"+name+"="+value)
+			} else {
+				args = append(args, "\x00"+name)
+			}
+		}
+	}
+	return args
+}
+
+// keyArgs returns args after applying the canonicalizer, ignored flags and preprocessor, i.e. the key
+// material without environment variables. The caller must hold cacheMutex.
+func keyArgs(args []string) []string {
+	if argCanonicalizer != nil {
+		canonical := make([]string, len(args))
+		for i, arg := range args {
+			canonical[i] = argCanonicalizer(arg)
+		}
+		args = canonical
+	}
+	if len(keyIgnoreFlags) > 0 {
+		args = stripIgnoredFlags(args)
+	}
+	if keyPreprocessor != nil {
+		args = keyPreprocessor(args)
+	}
+	return args
+}
+
+// ComputeKey returns the cache key that Set and Get use for the provided CLI arguments, applying
+// the whole configured key pipeline: SetArgCanonicalizer, SetKeyIgnoreFlags, SetKeyPreprocessor,
+// SetKeyEnv and SetKeyPrefix. Cache files are named after this key, and it is the token returned
+// by SetToken. Use it to store side data next to cache entries.
+//
+// args: Command line arguments which determine the cache key.
+//
+// Example:
+//
+//	key := clicache.ComputeKey(os.Args[1:])
+func ComputeKey(args []string) string {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	return generateCacheKey(args)
+}
+
+// HashArgs returns the cache key for the given CLI arguments: the hex-encoded SHA-256 hash of
+// the arguments formatted with fmt's %v verb. This is the canonical, stable key computation, and
+// cache files are named after it. It matches the key used by Set and Get unless arguments are
+// transformed by SetArgCanonicalizer, SetKeyIgnoreFlags or SetKeyPreprocessor, or environment
+// variables are mixed in by SetKeyEnv. A prefix set with SetKeyPrefix is not included; the key
+// is then the prefix, an underscore and the hash. Use ComputeKey for the configured key.
+//
+// args: Command line arguments which determine the cache key.
+//
+// Example:
+//
+//	key := clicache.HashArgs([]string{"command", "arg1", "arg2"})
+func HashArgs(args []string) string {
+	joinedArgs := fmt.Sprintf("%v", args)
+	hash := sha256.Sum256([]byte(joinedArgs))
+	return hex.EncodeToString(hash[:])
+}
+
+// getCacheFileName constructs the cache file name for the given cache key.
+func getCacheFileName(cacheKey string) string {
+	return filepath.Join(cacheFolder, cachePrefix+fmt.Sprintf("%s.gob", cacheKey))
+}
+
+// getCacheFiles returns the names of all cache files in the cache folder.
+func getCacheFiles() ([]string, error) {
+	return fs.Glob(filepath.Join(cacheFolder, cachePrefix+"*.gob"))
+}
+
+// getCacheKeyFromFileName extracts the cache key from the given cache file name.
+func getCacheKeyFromFileName(cacheFile string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(cacheFile), cachePrefix), ".gob")
+}
+
+// Cache is a helper function that retrieves the cached data associated with the provided CLI arguments.
+// If the cache entry is not found, the provided handler function is executed and its output is cached.
+// The data will expire after the specified TTL (in seconds).
+//
+// handler: Function that returns the data to be cached.
+//
+// Returns the cached data, ErrEmptyKey if there are no non-flag arguments, and an error if the
+// operation fails.
+//
+// Example:
+//
+//	out, err := clicache.Cache(func() (string, error) {
+//	  return "This is data.", nil
+//	})
+func Cache(handler func() (string, error)) (string, error) {
+	result, err := CacheWithResult(handler)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Data.(string), nil
+}
+
+// CacheWithResult works like Cache, but returns a CacheResult whose Source reports where the data
+// came from: SourceCache for a hit, SourceHandler for a miss, or SourceBypass if caching is disabled
+// with SetDisabled and the handler ran because of that.
+//
+// handler: Function that returns the data to be cached.
+//
+// Returns the result, holding the data as a string, and an error if the operation fails.
+//
+// Example:
+//
+//	result, err := clicache.CacheWithResult(fetch)
+//	if err == nil && result.Source == clicache.SourceBypass {
+//	  fmt.Fprintln(os.Stderr, "(cache bypassed)")
+//	}
+func CacheWithResult(handler func() (string, error)) (CacheResult, error) {
+	return cacheWithResult(handler, Set)
+}
+
+// cacheWithResult implements CacheWithResult, storing the handler's output with set.
+func cacheWithResult(handler func() (string, error), set func(args []string, data interface{}, ttl int) error) (CacheResult, error) {
+	if !flag.Parsed() {
+		warnDeprecated("cache-unparsed-flags", "clicache: Cache called before flag.Parse, all calls share one cache entry")
+	}
+
+	args := flag.Args()
+	cacheMutex.Lock()
+	err := checkKeyArgs(args)
+	cacheKey := generateCacheKey(args)
+	bypass := cacheDisabled
+	span := startSpan("clicache.Cache", cacheKey)
+	cacheMutex.Unlock()
+	defer span.End()
+
+	if err != nil {
+		if !flag.Parsed() {
+			return CacheResult{}, fmt.Errorf("%w: Cache uses flag.Args, but flag.Parse was not called", err)
+		}
+		return CacheResult{}, err
+	}
+
+	result := CacheResult{Args: args, Key: cacheKey}
+
+	cached, isCached, err := Get(args)
+	if err != nil {
+		return CacheResult{}, err
+	}
+	span.SetAttribute("clicache.hit", isCached)
+	if isCached {
+		result.Data, result.Found, result.Source = cached.(string), true, SourceCache
+		return result, nil
+	}
+
+	out, err := handler()
+	if err != nil {
+		return CacheResult{}, err
+	}
+
+	err = set(args, out, DefaultTTL)
+	if err != nil {
+		return CacheResult{}, err
+	}
+
+	result.Data, result.Source = out, SourceHandler
+	if bypass {
+		result.Source = SourceBypass
+	}
+
+	return result, nil
+}
+
+// CacheFunc has the signature of Cache.
+type CacheFunc func(handler func() (string, error)) (string, error)
+
+// ProvenanceCache returns a CacheFunc that behaves like Cache, but records the given provenance
+// label for the entries it stores instead of the one set by SetProvenance, like SetWithProvenance.
+// Entries found in the cache are returned regardless of their provenance.
+//
+// provenance: Label identifying the code that produces the data.
+//
+// Example:
+//
+//	cache := clicache.ProvenanceCache("fetcher-v2")
+//	out, err := cache(func() (string, error) {
+//	  return fetchV2()
+//	})
+func ProvenanceCache(provenance string) CacheFunc {
+	set := func(args []string, data interface{}, ttl int) error {
+		return SetWithProvenance(args, data, ttl, provenance)
+	}
+
+	return func(handler func() (string, error)) (string, error) {
+		result, err := cacheWithResult(handler, set)
+		if err != nil {
+			return "", err
+		}
+
+		return result.Data.(string), nil
+	}
+}
+
+// RateLimitedCache returns a CacheFunc that behaves like Cache, but limits handler invocations to
+// maxRPS per second across all of its callers. Cache hits are not limited. Callers that exceed the
+// rate on a cache miss receive ErrRateLimited instead of invoking the handler, which protects
+// downstream services from storms of cache misses.
+//
+// maxRPS: Maximum number of handler invocations per second. Zero or a negative value disables
+// the limit.
+//
+// Example:
+//
+//	cache := clicache.RateLimitedCache(10)
+//	out, err := cache(func() (string, error) {
+//	  return "This is data.", nil
+//	})
+//	if errors.Is(err, clicache.ErrRateLimited) {
+//	  // Back off and retry later
+//	}
+func RateLimitedCache(maxRPS int) CacheFunc {
+	limit := rate.Inf
+	if maxRPS > 0 {
+		limit = rate.Limit(maxRPS)
+	}
+	limiter := rate.NewLimiter(limit, maxRPS)
+
+	return func(handler func() (string, error)) (string, error) {
+		return Cache(func() (string, error) {
+			if !limiter.Allow() {
+				return "", ErrRateLimited
+			}
+			return handler()
+		})
+	}
+}
+
+// GetOrSetContext retrieves the cached value of type T associated with the provided CLI arguments.
+// If the cache entry is not found, fn is called with ctx and its result is cached for the given TTL.
+// An entry holding a value of a different type is reported as ErrTypeMismatch and left in place,
+// as in GetOrCompute. Values of non-builtin types must be registered with gob.Register before they
+// can be cached.
+//
+// ctx: Context passed to fn; GetOrSetContext returns early if it is already done.
+// args: Command line arguments which determine the cache key.
+// ttl: Time to live for the cache entry.
+// fn: Function that computes the value on a cache miss.
+//
+// Returns the cached or computed value, ErrTypeMismatch if the cached value is not a T, and an error
+// if the operation fails.
+//
+// Example:
+//
+//	args := []string{"command", "arg1", "arg2"}
+//	out, err := clicache.GetOrSetContext(ctx, args, time.Minute, func(ctx context.Context) (string, error) {
+//	  return "This is data.", nil
+//	})
+//	if err != nil {
+//	  log.Fatalf("Failed to get or set cache: %v", err)
+//	}
+func GetOrSetContext[T any](ctx context.Context, args []string, ttl time.Duration, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+
+	var cached T
+	found, err := DecodeAs(args, &cached)
+	if err != nil {
+		return zero, err
+	}
+	if found {
+		return cached, nil
+	}
+
+	value, err := fn(ctx)
+	if err != nil {
+		return zero, err
+	}
+
+	err = set(args, value, ttl)
+	if err != nil {
+		return zero, err
+	}
+
+	return value, nil
+}
+
+// GetOrSet retrieves the cached data associated with the provided CLI arguments, or calls compute
+// and caches its result with the given TTL (in seconds) on a miss. Calls for the same arguments are
+// serialized within the process, so computed is true for exactly one caller per lifetime of the
+// entry. This makes it suitable for piggybacking side effects on cache population. The guarantee
+// does not extend across processes.
+//
+// args: Command line arguments which determine the cache key.
+// ttl: Time to live in seconds for the cache entry.
+// compute: Function that computes the data on a cache miss.
+//
+// Returns the data, whether it was computed by this call, and an error if the operation fails.
+//
+// Example:
+//
+//	args := []string{"command", "arg1", "arg2"}
+//	data, computed, err := clicache.GetOrSet(args, 60, func() (interface{}, error) {
+//	  return "This is data.", nil
+//	})
+//	if err != nil {
+//	  log.Fatalf("Failed to get or set cache: %v", err)
+//	}
+//	if computed {
+//	  notify(data)
+//	}
+func GetOrSet(args []string, ttl int, compute func() (interface{}, error)) (interface{}, bool, error) {
+	cacheMutex.Lock()
+	cacheKey := generateCacheKey(args)
+	cacheMutex.Unlock()
+
+	unlock := lockKey(cacheKey)
+	defer unlock()
+
+	cached, isCached, err := Get(args)
+	if err != nil {
+		return nil, false, err
+	}
+	if isCached {
+		return cached, false, nil
+	}
+
+	data, err := compute()
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = Set(args, data, ttl)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return data, true, nil
+}
+
+// GetOrCompute retrieves the cached value of type T associated with the provided key, or calls
+// factory and caches its result with the given TTL (in seconds) on a miss. It is the generic,
+// explicit-key counterpart to Cache. Values of non-builtin types must be registered with
+// RegisterGobType before they can be cached.
+//
+// key: Arguments which determine the cache key.
+// ttl: Time to live in seconds for the cache entry.
+// factory: Function that computes the value on a cache miss.
+//
+// Returns the value, whether it was served from the cache, ErrTypeMismatch if the cached value is
+// not a T, in which case the entry is left in place, and an error if the operation fails.
+//
+// Example:
+//
+//	user, hit, err := clicache.GetOrCompute([]string{"user", "42"}, 60, func() (User, error) {
+//	  return fetchUser(42)
+//	})
+func GetOrCompute[T any](key []string, ttl int, factory func() (T, error)) (T, bool, error) {
+	var value T
+	found, err := DecodeAs(key, &value)
+	if err != nil {
+		return value, false, err
+	}
+	if found {
+		return value, true, nil
+	}
+
+	value, err = factory()
+	if err != nil {
+		return value, false, err
+	}
+
+	err = Set(key, value, ttl)
+	if err != nil {
+		return value, false, err
+	}
+
+	return value, false, nil
+}
+
+// CacheForFile retrieves the data cached for the current version of the file at path, or calls
+// handler and caches its result with the given TTL (in seconds) on a miss. The cache key includes
+// a fingerprint of the file, see SetFileFingerprint, so changing the file causes a miss.
+//
+// path: Path of the input file.
+// ttl: Time to live in seconds for the cache entry.
+// handler: Function that processes the file on a cache miss.
+//
+// Returns the cached or computed data and an error if the file cannot be read or the operation fails.
+//
+// Example:
+//
+//	report, err := clicache.CacheForFile("go.sum", 3600, func() (interface{}, error) {
+//	  return auditDependencies("go.sum")
+//	})
+func CacheForFile(path string, ttl int, handler func() (interface{}, error)) (interface{}, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cacheMutex.Lock()
+	fingerprint := fileFingerprint
+	cacheMutex.Unlock()
+
+	sum, err := fingerprintFile(absPath, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err := GetOrSet([]string{"clicache-file", absPath, sum}, ttl, handler)
+	return data, err
+}
+
+// fingerprintFile returns a string identifying the current version of the file at path.
+func fingerprintFile(path string, fingerprint FileFingerprint) (string, error) {
+	if fingerprint == FingerprintModTime {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", stat.ModTime().UnixNano(), stat.Size()), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// keyLock is a reference-counted mutex serializing operations on a single cache key.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockKey locks the given cache key and returns a function that unlocks it.
+// Locks are dropped from keyLocks once no caller holds or waits for them.
+func lockKey(cacheKey string) func() {
+	keyLocksMutex.Lock()
+	lock, ok := keyLocks[cacheKey]
+	if !ok {
+		lock = &keyLock{}
+		keyLocks[cacheKey] = lock
+	}
+	lock.refs++
+	keyLocksMutex.Unlock()
+
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+
+		keyLocksMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(keyLocks, cacheKey)
+		}
+		keyLocksMutex.Unlock()
+	}
+}
+
+// Set stores the given data in the cache, associated with the provided CLI arguments.
+// The data will expire after the specified TTL (in seconds). Pass DefaultTTL to use the TTL
+// resolved by SetTTLRules.
+//
+// args: Command line arguments which determine the cache key.
+// data: Data to be cached.
+// ttl: Time to live in seconds for the cache entry.
+//
+// Returns an error if the operation fails.
+//
+// Example:
+//
+//	args := []string{"command", "arg1", "arg2"}
+//	data := "This is cached data."
+//	ttl := 60  // 1 minute
+//	err := clicache.Set(args, data, ttl)
+//	if err != nil {
+//	  log.Fatalf("Failed to set cache: %v", err)
+//	}
+func Set(args []string, data interface{}, ttl int) error {
+	return set(args, data, time.Duration(ttl)*time.Second)
+}
+
+// SetWithTTLFunc stores the given data in the cache like Set, with a TTL derived from the data by
+// ttlFunc. This lets callers honor freshness information carried by the data itself, such as an
+// HTTP response's Cache-Control max-age. ttlFunc may return DefaultTTL to use the TTL rules.
+//
+// args: Command line arguments which determine the cache key.
+// data: Data to be cached.
+// ttlFunc: Function returning the time to live in seconds for data.
+//
+// Returns an error if ttlFunc returns a negative TTL other than DefaultTTL, or if the operation fails.
+//
+// Example:
+//
+//	err := clicache.SetWithTTLFunc(args, resp, func(data interface{}) int {
+//	  return maxAge(data.(Response).Header.Get("Cache-Control"))
+//	})
+func SetWithTTLFunc(args []string, data interface{}, ttlFunc func(data interface{}) int) error {
+	ttl := ttlFunc(data)
+	if ttl < 0 && ttl != DefaultTTL {
+		return fmt.Errorf("clicache: invalid TTL %d returned by TTL function", ttl)
+	}
+
+	return Set(args, data, ttl)
+}
+
+// set stores the given data in the cache with a TTL expressed as a duration.
+func set(args []string, data interface{}, ttl time.Duration) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	span := startSpan("clicache.Set", generateCacheKey(args))
+	defer span.End()
+
+	_, err := writeCacheItem(args, newCacheItem(args, data, ttl))
+	return err
+}
+
+// SetX stores the given data in the cache like Set, and reports whether it replaced an existing entry.
+// Entries that have expired but were not yet cleaned up count as existing. When nothing is written,
+// because caching is disabled or the conflict policy keeps the existing entry, SetX reports false.
+//
+// args: Command line arguments which determine the cache key.
+// data: Data to be cached.
+// ttl: Time to live in seconds for the cache entry.
+//
+// Returns whether an existing entry was overwritten, and an error if the operation fails.
+//
+// Example:
+//
+//	overwrote, err := clicache.SetX(args, data, 60)
+//	if err != nil {
+//	  log.Fatalf("Failed to set cache: %v", err)
+//	}
+//	if overwrote {
+//	  refreshed++
+//	}
+func SetX(args []string, data interface{}, ttl int) (bool, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	existed := false
+	file, err := fs.Open(getCacheFileName(generateCacheKey(args)))
+	if err == nil {
+		existed = true
+		_ = file.Close()
+	} else if !fs.IsNotExist(err) {
+		return false, err
+	}
+
+	wrote, err := writeCacheItem(args, newCacheItem(args, data, time.Duration(ttl)*time.Second))
+	if err != nil {
+		return false, err
+	}
+
+	return existed && wrote, nil
+}
+
+// SetToken stores the given data in the cache like Set, and returns an opaque token that identifies
+// the entry. Passing the token to InvalidateToken removes the entry without knowing its arguments.
+//
+// args: Command line arguments which determine the cache key.
+// data: Data to be cached.
+// ttl: Time to live in seconds for the cache entry.
+//
+// Returns the invalidation token and an error if the operation fails.
+//
+// Example:
+//
+//	token, err := clicache.SetToken(args, data, 60)
+//	if err != nil {
+//	  log.Fatalf("Failed to set cache: %v", err)
+//	}
+//	// Later, possibly elsewhere:
+//	err = clicache.InvalidateToken(token)
+func SetToken(args []string, data interface{}, ttl int) (string, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	_, err := writeCacheItem(args, newCacheItem(args, data, time.Duration(ttl)*time.Second))
+	if err != nil {
+		return "", err
+	}
+
+	return generateCacheKey(args), nil
+}
+
+// InvalidateToken removes the cache entry identified by a token returned from SetToken.
+// Removing an entry that no longer exists is not an error.
+//
+// token: Token returned by SetToken.
+//
+// Returns ErrInvalidToken if the token is malformed, and an error if the operation fails.
+//
+// Example:
+//
+//	err := clicache.InvalidateToken(token)
+//	if err != nil {
+//	  log.Fatalf("Failed to invalidate cache: %v", err)
+//	}
+func InvalidateToken(token string) error {
+	if !isValidToken(token) {
+		return ErrInvalidToken
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	return removeCacheFile(token)
+}
+
+// isValidToken reports whether token has the form of a cache key: a hex-encoded SHA-256 hash,
+// optionally preceded by a sanitized key prefix and an underscore.
+func isValidToken(token string) bool {
+	hashPart := token
+	if i := strings.LastIndex(token, "_"); i >= 0 {
+		prefix := token[:i]
+		if prefix == "" || sanitizeKeyPrefix(prefix) != prefix {
+			return false
+		}
+		hashPart = token[i+1:]
+	}
+
+	hash, err := hex.DecodeString(hashPart)
+	return err == nil && len(hash) == sha256.Size
+}
+
+// Forget removes the cache entry associated with the provided CLI arguments. Removing an entry that
+// does not exist is not an error. The name follows the cache-aside vocabulary used by other
+// ecosystems; see ForgetAll for removing every entry.
+//
+// ctx: Context bounding the operation.
+// args: Command line arguments which determine the cache key.
+//
+// Returns ctx.Err() if ctx is already done, and an error if the operation fails.
+//
+// Example:
+//
+//	err := clicache.Forget(ctx, []string{"user", "42"})
+//	if err != nil {
+//	  log.Fatalf("Failed to forget cache entry: %v", err)
+//	}
+func Forget(ctx context.Context, args []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if err := checkKeyArgs(args); err != nil {
+		return err
+	}
+
+	return removeCacheFile(generateCacheKey(args))
+}
+
+// removeCacheFile removes the cache file for the given key, ignoring a missing file.
+// The caller must hold cacheMutex.
+func removeCacheFile(key string) error {
+	err := fs.Remove(getCacheFileName(key))
+	if err != nil && !fs.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// SetWithProvenance stores the given data in the cache like Set, recording the given provenance
+// label instead of the one set by SetProvenance.
+//
+// args: Command line arguments which determine the cache key.
+// data: Data to be cached.
+// ttl: Time to live in seconds for the cache entry.
+// provenance: Label identifying the code that produced the data.
+//
+// Returns an error if the operation fails.
+//
+// Example:
+//
+//	err := clicache.SetWithProvenance(args, data, 60, "fetcher-legacy")
+func SetWithProvenance(args []string, data interface{}, ttl int, provenance string) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cacheItem := newCacheItem(args, data, time.Duration(ttl)*time.Second)
+	cacheItem.Provenance = provenance
+
+	_, err := writeCacheItem(args, cacheItem)
+	return err
+}
+
+// SetWithDeps stores the given data in the cache like Set, and records the entries it depends on.
+// The entry is treated as a miss by Get once any dependency has been set again after it, or no
+// longer exists, so derived results are recomputed whenever their inputs change.
+//
+// args: Command line arguments which determine the cache key.
+// data: Data to be cached.
+// ttl: Time to live in seconds for the cache entry.
+// deps: Command line arguments of the entries this entry depends on.
+//
+// Returns an error if the operation fails.
+//
+// Example:
+//
+//	err := clicache.SetWithDeps([]string{"report"}, report, 60, [][]string{{"fetch", "users"}})
+//	if err != nil {
+//	  log.Fatalf("Failed to set cache: %v", err)
+//	}
+func SetWithDeps(args []string, data interface{}, ttl int, deps [][]string) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cacheItem := newCacheItem(args, data, time.Duration(ttl)*time.Second)
+	for _, dep := range deps {
+		cacheItem.Deps = append(cacheItem.Deps, generateCacheKey(dep))
+	}
+
+	_, err := writeCacheItem(args, cacheItem)
+	return err
+}
+
+// newCacheItem creates a cache item holding the given data that expires after ttl. A negative ttl,
+// e.g. DefaultTTL, is replaced by the TTL resolved for args. The caller must hold cacheMutex.
+func newCacheItem(args []string, data interface{}, ttl time.Duration) CacheItem {
+	if ttl < 0 {
+		ttl, _ = resolveTTL(args)
+	}
+	if dataSanitizer != nil {
+		data = dataSanitizer(data)
+	}
+	now := time.Now()
+	return CacheItem{
+		Expiration: now.Add(ttl),
+		Data:       data,
+		Created:    now,
+		Provenance: provenance,
+	}
+}
+
+// writeCacheItem stores the cache item associated with the provided CLI arguments, applying the
+// conflict policy, and cleans up expired cache entries. The caller must hold cacheMutex.
+//
+// Returns whether the item was written, which is false if caching is disabled or the
+// FirstWriteWins policy kept an existing entry, and an error if the operation fails.
+func writeCacheItem(args []string, cacheItem CacheItem) (bool, error) {
+	if err := checkKeyArgs(args); err != nil {
+		return false, err
+	}
+
+	if cacheDisabled {
+		return false, nil
+	}
+
+	if conflictPolicy != LastWriteWins && hasFreshEntry(args) {
+		if conflictPolicy == Reject {
+			return false, ErrEntryExists
+		}
+		return false, nil
+	}
+
+	return putCacheItem(args, cacheItem)
+}
+
+// hasFreshEntry reports whether a readable, unexpired entry exists for the provided CLI arguments.
+// The caller must hold cacheMutex.
+func hasFreshEntry(args []string) bool {
+	existing, err := readCacheItem(getCacheFileName(generateCacheKey(args)))
+	return err == nil && !time.Now().After(existing.Expiration) && !exceedsMaxAge(existing, time.Now())
+}
+
+// putCacheItem stores the cache item associated with the provided CLI arguments regardless of the
+// conflict policy, and cleans up expired cache entries. It is used directly by read-modify-write
+// operations, which replace an entry on purpose. The caller must hold cacheMutex.
+//
+// Returns whether the item was written, which is false if caching is disabled, and an error if the
+// operation fails.
+func putCacheItem(args []string, cacheItem CacheItem) (bool, error) {
+	if err := checkKeyArgs(args); err != nil {
+		return false, err
+	}
+
+	if cacheDisabled {
+		return false, nil
+	}
+
+	cacheFile := getCacheFileName(generateCacheKey(args))
+	if storeArgs {
+		cacheItem.Args = append([]string(nil), args...)
+	}
+
+	encoded, err := encodeCacheItem(cacheItem)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := fs.Create(cacheFile)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	_, err = file.Write(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	gc() // Clean up expired cache entries.
+
+	return true, nil
+}
+
+// encodeCacheItem encodes the cache item, applying the JSON fallback and checksum settings.
+// The caller must hold cacheMutex.
+func encodeCacheItem(cacheItem CacheItem) ([]byte, error) {
+	cacheItem.Format = formatVersion
+
+	if checksumEnabled {
+		payload, err := encodeGob(&cacheItem.Data)
+		switch {
+		case err == nil:
+			cacheItem.Payload = payload
+		case jsonFallback:
+			payload, err = json.Marshal(cacheItem.Data)
+			if err != nil {
+				return nil, err
+			}
+			cacheItem.JSONData = payload
+		default:
+			return nil, err
+		}
+		cacheItem.Data = nil
+		cacheItem.Checksum = computeChecksum(payload)
+		return encodeGob(&cacheItem)
+	}
+
+	encoded, err := encodeGob(&cacheItem)
+	if err == nil || !jsonFallback {
+		return encoded, err
+	}
+
+	cacheItem.JSONData, err = json.Marshal(cacheItem.Data)
+	if err != nil {
+		return nil, err
+	}
+	cacheItem.Data = nil
+	return encodeGob(&cacheItem)
+}
+
+// encodeGob returns the gob encoding of v.
+func encodeGob(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+// computeChecksum returns the hex-encoded SHA-256 hash of the given data.
+func computeChecksum(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// readCacheItem decodes the cache item stored in the given file.
+// The caller must hold cacheMutex.
+func readCacheItem(cacheFile string) (CacheItem, error) {
+	file, err := fs.Open(cacheFile)
+	if err != nil {
+		return CacheItem{}, err
+	}
+	defer file.Close()
+
+	return decodeCacheItem(file)
+}
+
+// ReadLegacyEntry decodes a cache entry in the format written by this or an earlier version of
+// clicache, verifying its checksum if it has one. Data of non-builtin types must be registered
+// with RegisterGobType first. Data stored by the JSON fallback is left in JSONData.
+//
+// r: Reader positioned at the start of the entry, e.g. an opened cache file.
+//
+// Returns the cache item, ErrChecksumMismatch if the data does not match its checksum,
+// ErrUnsupportedFormat if the entry was written in a newer format, and an error if the entry cannot
+// be decoded.
+//
+// Example:
+//
+//	f, err := os.Open(filepath.Join(oldCacheDir, "cli_cache_"+key+".gob"))
+//	if err != nil {
+//	  log.Fatalf("Failed to open cache file: %v", err)
+//	}
+//	defer f.Close()
+//	item, err := clicache.ReadLegacyEntry(f)
+func ReadLegacyEntry(r io.Reader) (CacheItem, error) {
+	return decodeCacheItem(r)
+}
+
+// decodeCacheItem decodes a cache item from r, verifying its format version and its checksum if
+// it has one. Data stored by the JSON fallback is left in JSONData.
+func decodeCacheItem(r io.Reader) (CacheItem, error) {
+	var cacheItem CacheItem
+	err := gob.NewDecoder(r).Decode(&cacheItem)
+	if err != nil {
+		return cacheItem, err
+	}
+	if cacheItem.Format > formatVersion {
+		return CacheItem{}, fmt.Errorf("%w: %d", ErrUnsupportedFormat, cacheItem.Format)
+	}
+	if cacheItem.Checksum == "" {
+		return cacheItem, nil
+	}
+
+	payload := cacheItem.Payload
+	if len(cacheItem.JSONData) > 0 {
+		payload = cacheItem.JSONData
+	}
+	if computeChecksum(payload) != cacheItem.Checksum {
+		return cacheItem, ErrChecksumMismatch
+	}
+
+	if len(cacheItem.Payload) > 0 {
+		err = gob.NewDecoder(bytes.NewReader(cacheItem.Payload)).Decode(&cacheItem.Data)
+		cacheItem.Payload = nil
+	}
+
+	return cacheItem, err
+}
+
+// decodeData decodes the cache item's data into target, which must be a non-nil pointer.
+// Data stored by the JSON fallback is unmarshalled into target. Data of a different type than
+// target is reported as ErrTypeMismatch.
+func decodeData(cacheItem CacheItem, target interface{}) error {
+	if len(cacheItem.JSONData) > 0 {
+		err := json.Unmarshal(cacheItem.JSONData, target)
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%w: %v", ErrTypeMismatch, err)
+		}
+		return err
+	}
+
+	value := reflect.ValueOf(target)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return fmt.Errorf("clicache: target must be a non-nil pointer, got %T", target)
+	}
+	if cacheItem.Data == nil {
+		value.Elem().Set(reflect.Zero(value.Elem().Type()))
+		return nil
+	}
+
+	data := reflect.ValueOf(cacheItem.Data)
+	if !data.Type().AssignableTo(value.Elem().Type()) {
+		return fmt.Errorf("%w: cannot decode %T into %T", ErrTypeMismatch, cacheItem.Data, target)
+	}
+	value.Elem().Set(data)
+	return nil
+}
+
+// dependenciesChanged reports whether any dependency of the cache item was set after it,
+// or no longer exists. The caller must hold cacheMutex.
+func dependenciesChanged(cacheItem CacheItem) bool {
+	for _, dep := range cacheItem.Deps {
+		depItem, err := readCacheItem(getCacheFileName(dep))
+		if err != nil || time.Now().After(depItem.Expiration) || depItem.Created.After(cacheItem.Created) {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendToCache appends item to the list cached for the provided CLI arguments, keeping at most the
+// maxItems most recent items, and stores the list with the given TTL. A missing or expired entry
+// starts a new list. The read-modify-write runs under a single lock, so concurrent appends are not lost.
+// Items of non-builtin types must be registered with gob.Register.
+//
+// args: Command line arguments which determine the cache key.
+// item: Item to append.
+// maxItems: Maximum number of items to keep; zero or less keeps all items.
+// ttl: Time to live for the cache entry.
+//
+// Returns an error if the existing entry is not a list or the operation fails.
+//
+// Example:
+//
+//	err := clicache.AppendToCache([]string{"history"}, "deploy v1.2.3", 100, 24*time.Hour)
+//	if err != nil {
+//	  log.Fatalf("Failed to append to cache: %v", err)
+//	}
+func AppendToCache(args []string, item interface{}, maxItems int, ttl time.Duration) error {
+	return Modify(args, func(current interface{}) (interface{}, time.Duration, error) {
+		items, ok := current.([]interface{})
+		if current != nil && !ok {
+			return nil, 0, fmt.Errorf("%w: cannot append to %T", ErrTypeMismatch, current)
+		}
+
+		items = append(items, item)
+		if maxItems > 0 && len(items) > maxItems {
+			items = items[len(items)-maxItems:]
+		}
+
+		return items, ttl, nil
+	})
+}
+
+// Modify atomically updates the cached data associated with the provided CLI arguments. It calls fn
+// with the current data, or nil if there is no fresh entry, and stores the data fn returns with the
+// TTL it returns. If fn returns nil data, the entry is removed. If fn returns an error, the entry is
+// left unchanged and the error is returned. The read-modify-write runs under a single lock, so fn
+// must not call other clicache functions. Since Modify replaces the entry on purpose, the policy set
+// with SetConflictPolicy does not apply to it.
+//
+// args: Command line arguments which determine the cache key.
+// fn: Function that computes the new data and TTL from the current data.
+//
+// Returns an error if fn or the operation fails.
+//
+// Example:
+//
+//	err := clicache.Modify([]string{"settings"}, func(current interface{}) (interface{}, time.Duration, error) {
+//	  if current == nil {
+//	    return "defaults", time.Hour, nil
+//	  }
+//	  return current.(string) + ",updated", time.Hour, nil
+//	})
+func Modify(args []string, fn func(current interface{}) (interface{}, time.Duration, error)) error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	_, cacheItem, found, err := getCacheItem(args)
+	if err != nil {
+		return err
+	}
+
+	var current interface{}
+	if found {
+		err = decodeData(cacheItem, &current)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, ttl, err := fn(current)
+	if err != nil {
+		return err
+	}
+
+	if data == nil {
+		return removeCacheFile(generateCacheKey(args))
+	}
+
+	_, err = putCacheItem(args, newCacheItem(args, data, ttl))
+	return err
+}
+
+// IncrBy atomically adds delta to the integer cached for the provided CLI arguments and stores the
+// result with the given TTL. A missing or expired entry counts as 0.
+//
+// args: Command line arguments which determine the cache key.
+// delta: Amount to add, may be negative.
+// ttl: Time to live for the updated cache entry.
+//
+// Returns the new value, ErrTypeMismatch if the entry holds something other than an int64, and an
+// error if the operation fails.
+//
+// Example:
+//
+//	remaining, err := clicache.IncrBy([]string{"ratelimit", "github"}, -1, time.Hour)
+func IncrBy(args []string, delta int64, ttl time.Duration) (int64, error) {
+	var value int64
+	err := Modify(args, func(current interface{}) (interface{}, time.Duration, error) {
+		if current != nil {
+			n, ok := current.(int64)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: cannot increment %T", ErrTypeMismatch, current)
+			}
+			value = n
+		}
+
+		value += delta
+		return value, ttl, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+// SetPipeline collects Set operations and executes them together. Create one with NewSetPipeline.
+type SetPipeline struct {
+	ops []pipelineOp
+}
+
+// pipelineOp is a single Set operation of a SetPipeline.
+type pipelineOp struct {
+	args []string
+	data interface{}
+	ttl  int
+}
+
+// NewSetPipeline creates an empty SetPipeline.
+//
+// Example:
+//
+//	pipe := clicache.NewSetPipeline()
+//	pipe.Add([]string{"summary"}, summary, 60)
+//	pipe.Add([]string{"detail"}, detail, 60)
+//	if err := pipe.Execute(); err != nil {
+//	  log.Fatalf("Failed to update cache: %v", err)
+//	}
+func NewSetPipeline() *SetPipeline {
+	return &SetPipeline{}
+}
+
+// Add queues storing data for the provided CLI arguments with the given TTL (in seconds).
+// Nothing is written until Execute is called.
+func (p *SetPipeline) Add(args []string, data interface{}, ttl int) {
+	p.ops = append(p.ops, pipelineOp{args: args, data: data, ttl: ttl})
+}
+
+// Execute writes all queued entries under a single lock. If a write fails, every entry touched by
+// this pipeline is rolled back: entries that existed before are restored to their previous contents,
+// and entries that did not exist are removed, so that the cache never holds only part of the update.
+// Entries skipped because of the conflict policy are left as they are.
+//
+// Returns an error if any write fails.
+func (p *SetPipeline) Execute() error {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	written := make([]fileSnapshot, 0, len(p.ops))
+	for _, op := range p.ops {
+		snapshot, err := takeFileSnapshot(getCacheFileName(generateCacheKey(op.args)))
+		if err != nil {
+			rollbackSnapshots(written)
+			return err
+		}
+
+		wrote, err := writeCacheItem(op.args, newCacheItem(op.args, op.data, time.Duration(op.ttl)*time.Second))
+		if err != nil {
+			// The failing write may have left a partial file behind, so it is rolled back as well.
+			rollbackSnapshots(append(written, snapshot))
+			return err
+		}
+		if wrote {
+			written = append(written, snapshot)
+		}
+	}
+
+	return nil
+}
+
+// fileSnapshot records the contents of a cache file before it is overwritten.
+type fileSnapshot struct {
+	name    string
+	data    []byte
+	existed bool
+}
+
+// takeFileSnapshot reads the current contents of the named cache file, if it exists.
+func takeFileSnapshot(name string) (fileSnapshot, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return fileSnapshot{name: name}, nil
+		}
+		return fileSnapshot{}, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fileSnapshot{}, err
+	}
+
+	return fileSnapshot{name: name, data: data, existed: true}, nil
+}
+
+// rollbackSnapshots restores the given snapshots in reverse order, so that a file written more than
+// once ends up with the contents it had before the first write. Errors are ignored, as rollback is
+// best-effort.
+func rollbackSnapshots(snapshots []fileSnapshot) {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		if !snapshot.existed {
+			_ = fs.Remove(snapshot.name)
+			continue
+		}
+
+		file, err := fs.Create(snapshot.name)
+		if err != nil {
+			continue
+		}
+		_, _ = file.Write(snapshot.data)
+		_ = file.Close()
+	}
+}
+
+// tempFileName returns a unique name for a temporary file that is renamed to name once complete.
+// Such files match auxiliaryFilePatterns, so gc removes them if a crash leaves them behind.
+// The caller must hold cacheMutex.
+func tempFileName(name string) string {
+	tempSeq++
+	return fmt.Sprintf("%s.%d-%d.tmp", name, os.Getpid(), tempSeq)
+}
+
+// Tx stages Set operations as temporary files and publishes them together on Commit. Create one with
+// Begin. A Tx is not safe for concurrent use.
+//
+// Commit publishes the staged files by renaming them one after another under the cache lock, so other
+// goroutines of this process see either none or all of the entries. The renames are not atomic as a
+// group, though: other processes may observe a prefix of them, and if the process dies or a rename
+// fails midway, the entries renamed so far stay published while the rest are discarded. Temporary
+// files left behind by a crash are named like the target cache file with a ".tmp" suffix; gc and
+// Cleanup remove them once they are older than auxiliaryMaxAge.
+type Tx struct {
+	staged []stagedFile
+	done   bool
+}
+
+// stagedFile is a cache entry written to a temporary file by Tx.Set.
+type stagedFile struct {
+	args []string
+	tmp  string
+}
+
+// Begin starts a transaction.
+//
+// Example:
+//
+//	tx := clicache.Begin()
+//	defer tx.Rollback()
+//	if err := tx.Set([]string{"summary"}, summary, 60); err != nil {
+//	  log.Fatalf("Failed to stage cache entry: %v", err)
+//	}
+//	if err := tx.Set([]string{"detail"}, detail, 60); err != nil {
+//	  log.Fatalf("Failed to stage cache entry: %v", err)
+//	}
+//	if err := tx.Commit(); err != nil {
+//	  log.Fatalf("Failed to update cache: %v", err)
+//	}
+func Begin() *Tx {
+	return &Tx{}
+}
+
+// Set stages storing data for the provided CLI arguments with the given TTL (in seconds). The entry is
+// written to a temporary file and is not visible until Commit is called. Nothing is staged while
+// caching is disabled.
+//
+// Returns ErrTxDone if the transaction is finished, and an error if the operation fails.
+func (tx *Tx) Set(args []string, data interface{}, ttl int) error {
+	if tx.done {
+		return ErrTxDone
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if err := checkKeyArgs(args); err != nil {
+		return err
+	}
+	if cacheDisabled {
+		return nil
+	}
+
+	cacheItem := newCacheItem(args, data, time.Duration(ttl)*time.Second)
+	if storeArgs {
+		cacheItem.Args = append([]string(nil), args...)
+	}
+
+	encoded, err := encodeCacheItem(cacheItem)
+	if err != nil {
+		return err
+	}
+
+	tmp := tempFileName(getCacheFileName(generateCacheKey(args)))
+	file, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(encoded)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmp)
+		return err
+	}
+
+	tx.staged = append(tx.staged, stagedFile{args: args, tmp: tmp})
+	return nil
+}
+
+// Commit publishes the staged entries. The conflict policy is checked for all entries before any is
+// published: under Reject, a fresh entry for any staged key fails the whole commit with
+// ErrEntryExists, and under FirstWriteWins, staged entries whose key has a fresh entry are discarded.
+// If a rename fails, the entries renamed so far stay published, see Tx.
+//
+// Returns ErrTxDone if the transaction is finished, and an error if the operation fails.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	publish := make([]stagedFile, 0, len(tx.staged))
+	for _, staged := range tx.staged {
+		if conflictPolicy != LastWriteWins && hasFreshEntry(staged.args) {
+			if conflictPolicy == Reject {
+				discardStaged(tx.staged)
+				return ErrEntryExists
+			}
+			_ = fs.Remove(staged.tmp)
+			continue
+		}
+		publish = append(publish, staged)
+	}
+
+	for i, staged := range publish {
+		if err := fs.Rename(staged.tmp, getCacheFileName(generateCacheKey(staged.args))); err != nil {
+			discardStaged(publish[i:])
+			return err
+		}
+	}
+
+	gc() // Clean up expired cache entries.
+
+	return nil
+}
+
+// Rollback discards the staged entries. Like database/sql, it returns ErrTxDone once the transaction
+// is finished, so it can be deferred right after Begin and its error ignored.
+//
+// Returns ErrTxDone if the transaction was already committed or rolled back.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	discardStaged(tx.staged)
+	return nil
+}
+
+// discardStaged removes the temporary files of the given staged entries. Errors are ignored.
+func discardStaged(staged []stagedFile) {
+	for _, file := range staged {
+		_ = fs.Remove(file.tmp)
+	}
+}
+
+// Get retrieves the cached data associated with the provided CLI arguments.
+//
+// args: Command line arguments which determine the cache key.
+//
+// Returns the cached data, a boolean indicating if the cache entry was found, and an error if the operation fails.
+//
+// Example:
+//
+//	args := []string{"command", "arg1", "arg2"}
+//	data, found, err := clicache.Get(args)
+//	if err != nil {
+//	  log.Fatalf("Failed to get cache: %v", err)
+//	}
+//	if found {
+//	  fmt.Println("Cached data:", data)
+//	} else {
+//	  fmt.Println("Cache not found.")
+//	}
+func Get(args []string) (interface{}, bool, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	span := startSpan("clicache.Get", generateCacheKey(args))
+	defer span.End()
+
+	cacheKey, cacheItem, found, err := getCacheItem(args)
+	if err != nil || !found {
+		span.SetAttribute("clicache.hit", false)
+		return nil, false, err
+	}
+
+	var data interface{}
+	err = decodeData(cacheItem, &data)
+	if err != nil {
+		span.SetAttribute("clicache.hit", false)
+		return nil, false, err
+	}
+
+	span.SetAttribute("clicache.hit", true)
+	recordAccess(cacheKey)
+
+	return data, true, nil
+}
+
+// DefaultPollInterval is the poll interval WaitForEntry uses when given a non-positive one.
+const DefaultPollInterval = 100 * time.Millisecond
+
+// WaitForEntry waits until data is cached for the provided CLI arguments, for example by another
+// process, and returns it. The cache is checked every pollInterval.
+//
+// ctx: Context bounding the wait.
+// args: Command line arguments which determine the cache key.
+// pollInterval: Time between checks. Values <= 0 fall back to DefaultPollInterval.
+//
+// Returns the cached data, ErrEntryNeverAppeared if ctx times out, ctx.Err() if ctx is canceled,
+// and an error if reading the cache fails.
+//
+// Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	out, err := clicache.WaitForEntry(ctx, []string{"build", "artifacts"}, 500*time.Millisecond)
+func WaitForEntry(ctx context.Context, args []string, pollInterval time.Duration) (interface{}, error) {
+	if pollInterval <= 0 {
+		pollInterval = DefaultPollInterval
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				return nil, ErrEntryNeverAppeared
+			}
+			return nil, err
+		}
+
+		data, found, err := Get(args)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return data, nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+}
+
+// DecodeAs retrieves the cached data associated with the provided CLI arguments and stores it in
+// the value pointed to by target. Unlike Get, a type mismatch is reported as an error instead of
+// causing a panic at the caller's type assertion.
+//
+// args: Command line arguments which determine the cache key.
+// target: Non-nil pointer to a value of the cached data's type.
+//
+// Returns a boolean indicating if the cache entry was found, ErrTypeMismatch if the cached data does
+// not fit target, and an error if the operation fails.
+//
+// Example:
+//
+//	var user User
+//	found, err := clicache.DecodeAs([]string{"user", "42"}, &user)
+//	if err != nil {
+//	  log.Fatalf("Failed to decode cache: %v", err)
+//	}
+func DecodeAs(args []string, target interface{}) (bool, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cacheKey, cacheItem, found, err := getCacheItem(args)
+	if err != nil || !found {
+		return false, err
+	}
+
+	err = decodeData(cacheItem, target)
+	if err != nil {
+		return false, err
+	}
+
+	recordAccess(cacheKey)
+
+	return true, nil
+}
+
+// getCacheItem reads the cache item associated with the provided CLI arguments, removing it if it
+// is expired or unreadable. The caller must hold cacheMutex.
+//
+// Returns the cache key, the cache item, a boolean indicating if a fresh entry was found, and an
+// error if the operation fails.
+func getCacheItem(args []string) (string, CacheItem, bool, error) {
+	cacheKey := generateCacheKey(args)
+	cacheFile := getCacheFileName(cacheKey)
+
+	if err := checkKeyArgs(args); err != nil {
+		return cacheKey, CacheItem{}, false, err
+	}
+
+	if cacheDisabled {
+		return cacheKey, CacheItem{}, false, nil
+	}
+
+	file, err := fs.Open(cacheFile)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			cacheItem, found := readEmbeddedItem(cacheKey)
+			return cacheKey, cacheItem, found, nil
+		}
+		return cacheKey, CacheItem{}, false, err
+	}
+	defer file.Close()
+
+	cacheItem, err := decodeCacheItem(file)
+
+	gc() // Clean up expired cache entries.
+
+	if errors.Is(err, ErrChecksumMismatch) {
+		_ = fs.Remove(cacheFile)
+		return cacheKey, CacheItem{}, false, err
+	}
+
+	if err != nil && isInFlightWrite(file, err) {
+		return cacheKey, CacheItem{}, false, nil
+	}
+
+	if err != nil || time.Now().After(cacheItem.Expiration) {
+		_ = fs.Remove(cacheFile)
+		return cacheKey, CacheItem{}, false, nil
+	}
+
+	if exceedsMaxAge(cacheItem, time.Now()) || dependenciesChanged(cacheItem) {
+		return cacheKey, CacheItem{}, false, nil
+	}
+
+	return cacheKey, cacheItem, true, nil
+}
+
+// ExplainReason is the outcome of a lookup reported by Explain.
+type ExplainReason string
+
+const (
+	// ExplainHit means a lookup would return the entry.
+	ExplainHit ExplainReason = "hit"
+	// ExplainDisabled means caching is disabled with SetDisabled.
+	ExplainDisabled ExplainReason = "disabled"
+	// ExplainEmptyKey means the arguments are empty, see SetAllowEmptyKey.
+	ExplainEmptyKey ExplainReason = "empty key"
+	// ExplainNotFound means there is no cache file and no embedded entry.
+	ExplainNotFound ExplainReason = "not found"
+	// ExplainChecksumMismatch means the entry's data does not match its stored checksum.
+	ExplainChecksumMismatch ExplainReason = "checksum mismatch"
+	// ExplainWriteInFlight means the cache file is incomplete because it is still being written.
+	ExplainWriteInFlight ExplainReason = "write in flight"
+	// ExplainUnsupportedFormat means the entry was written in a newer format, see FormatVersion.
+	ExplainUnsupportedFormat ExplainReason = "unsupported format"
+	// ExplainCorrupt means the cache file cannot be decoded.
+	ExplainCorrupt ExplainReason = "corrupt"
+	// ExplainExpired means the entry's TTL has elapsed.
+	ExplainExpired ExplainReason = "expired"
+	// ExplainMaxAge means the entry is older than the age set with SetMaxAge.
+	ExplainMaxAge ExplainReason = "max age exceeded"
+	// ExplainDependencyChanged means an entry the entry depends on changed or expired, see SetWithDeps.
+	ExplainDependencyChanged ExplainReason = "dependency changed"
+)
+
+// KeyEnvVar describes an environment variable mixed into the cache key, see SetKeyEnv.
+type KeyEnvVar struct {
+	Name string
+	// Set reports whether the variable is set, possibly to the empty string.
+	Set bool
+}
+
+// Explanation describes how clicache would handle a lookup for a set of arguments.
+type Explanation struct {
+	// Args are the arguments passed to Explain.
+	Args []string
+	// KeyArgs are the arguments hashed into the key, after SetArgCanonicalizer, SetKeyIgnoreFlags and
+	// SetKeyPreprocessor were applied.
+	KeyArgs []string
+	// KeyEnv lists the environment variables set with SetKeyEnv, which are hashed into the key as well.
+	// Their values are never reported, since they may hold secrets.
+	KeyEnv []KeyEnvVar
+	Key    string
+	File   string
+	// Exists reports whether the cache file exists.
+	Exists bool
+	// Embedded reports whether the entry would be served from the layer set with SetEmbeddedFS.
+	Embedded   bool
+	Reason     ExplainReason
+	Created    time.Time
+	Expiration time.Time
+	Provenance string
+	// TTL is the TTL that Set with DefaultTTL would use, and TTLRule the name of the matching rule.
+	TTL     time.Duration
+	TTLRule string
+}
+
+// Explain reports how a lookup for the provided CLI arguments would be handled: the derived key and
+// file, the key material, and whether the lookup would hit or why it would miss. Unlike Get, it
+// does not remove expired or invalid entries and does not record access statistics.
+//
+// args: Command line arguments which determine the cache key.
+//
+// Returns the explanation and an error if the cache file cannot be opened for reasons other than
+// not existing.
+//
+// Example:
+//
+//	explanation, err := clicache.Explain(os.Args[1:])
+//	if err != nil {
+//	  log.Fatalf("Failed to explain cache: %v", err)
+//	}
+//	_ = json.NewEncoder(os.Stdout).Encode(explanation)
+func Explain(args []string) (Explanation, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	e, _, err := explain(args)
+	return e, err
+}
+
+// explain classifies a lookup for the provided CLI arguments like Explain, and also returns the
+// cache item on a hit. It has no side effects on the cache. The caller must hold cacheMutex.
+func explain(args []string) (Explanation, CacheItem, error) {
+	e := Explanation{
+		Args:    args,
+		KeyArgs: keyArgs(args),
+		Key:     generateCacheKey(args),
+	}
+	for _, name := range keyEnv {
+		_, set := os.LookupEnv(name)
+		e.KeyEnv = append(e.KeyEnv, KeyEnvVar{Name: name, Set: set})
+	}
+	e.File = getCacheFileName(e.Key)
+	e.TTL, e.TTLRule = resolveTTL(args)
+
+	if checkKeyArgs(args) != nil {
+		e.Reason = ExplainEmptyKey
+		return e, CacheItem{}, nil
+	}
+	if cacheDisabled {
+		e.Reason = ExplainDisabled
+		return e, CacheItem{}, nil
+	}
+
+	file, err := fs.Open(e.File)
+	if err != nil {
+		if !fs.IsNotExist(err) {
+			return e, CacheItem{}, err
+		}
+		cacheItem, found := readEmbeddedItem(e.Key)
+		if !found {
+			e.Reason = ExplainNotFound
+			return e, CacheItem{}, nil
+		}
+		e.Embedded = true
+		e.Reason = ExplainHit
+		e.Created, e.Expiration, e.Provenance = cacheItem.Created, cacheItem.Expiration, cacheItem.Provenance
+		return e, cacheItem, nil
+	}
+	defer file.Close()
+	e.Exists = true
+
+	cacheItem, err := decodeCacheItem(file)
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		e.Reason = ExplainChecksumMismatch
+		return e, CacheItem{}, nil
+	case errors.Is(err, ErrUnsupportedFormat):
+		e.Reason = ExplainUnsupportedFormat
+		return e, CacheItem{}, nil
+	case err != nil && isInFlightWrite(file, err):
+		e.Reason = ExplainWriteInFlight
+		return e, CacheItem{}, nil
+	case err != nil:
+		e.Reason = ExplainCorrupt
+		return e, CacheItem{}, nil
+	}
+
+	e.Created, e.Expiration, e.Provenance = cacheItem.Created, cacheItem.Expiration, cacheItem.Provenance
+	now := time.Now()
+	switch {
+	case now.After(cacheItem.Expiration):
+		e.Reason = ExplainExpired
+	case exceedsMaxAge(cacheItem, now):
+		e.Reason = ExplainMaxAge
+	case dependenciesChanged(cacheItem):
+		e.Reason = ExplainDependencyChanged
+	default:
+		e.Reason = ExplainHit
+		return e, cacheItem, nil
+	}
+
+	return e, CacheItem{}, nil
+}
+
+// ResultSource tells where the data of a CacheResult came from.
+type ResultSource int
+
+const (
+	// SourceCache means the data was read from the cache.
+	SourceCache ResultSource = iota + 1
+	// SourceHandler means the data was computed by the handler because of a cache miss.
+	SourceHandler
+	// SourceBypass means the data was computed by the handler because caching is disabled.
+	SourceBypass
+)
+
+// CacheResult is the result of a lookup of a single cache entry. Source is zero if there is no data.
+type CacheResult struct {
+	Args       []string
+	Key        string
+	Data       interface{}
+	Found      bool
+	Source     ResultSource
+	Created    time.Time
+	Expiration time.Time
+}
+
+// PeekMany looks up the cache entries for several sets of CLI arguments without side effects:
+// unlike Get, it records no access statistics and removes no expired or invalid entries, which
+// makes it suitable for status commands that must not disturb the cache they inspect.
+//
+// argsSets: Command line arguments of each entry to look up.
+//
+// Returns one result per set of arguments, in order, and an error if a cache file cannot be read
+// or decoded.
+//
+// Example:
+//
+//	results, err := clicache.PeekMany([][]string{{"status"}, {"releases", "list"}})
+//	for _, r := range results {
+//	  fmt.Println(r.Args, r.Found, r.Expiration)
+//	}
+func PeekMany(argsSets [][]string) ([]CacheResult, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	results := make([]CacheResult, 0, len(argsSets))
+	for _, args := range argsSets {
+		e, cacheItem, err := explain(args)
+		if err != nil {
+			return nil, err
+		}
+
+		result := CacheResult{Args: args, Key: e.Key}
+		if e.Reason == ExplainHit {
+			err = decodeData(cacheItem, &result.Data)
+			if err != nil {
+				return nil, err
+			}
+			result.Found, result.Source = true, SourceCache
+			result.Created, result.Expiration = cacheItem.Created, cacheItem.Expiration
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// AccessStats returns the number of cache hits per cache key recorded by Get in this process.
+// Once maxAccessStatsKeys keys are tracked, hits for new keys are no longer recorded.
+//
+// Example:
+//
+//	for key, hits := range clicache.AccessStats() {
+//	  fmt.Println(key, hits)
+//	}
+func AccessStats() map[string]int {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	stats := make(map[string]int, len(accessCounts))
+	for key, hits := range accessCounts {
+		stats[key] = hits
+	}
+	return stats
+}
+
+// recordAccess increments the hit counter of the given cache key.
+// The caller must hold cacheMutex.
+func recordAccess(cacheKey string) {
+	if _, ok := accessCounts[cacheKey]; !ok && len(accessCounts) >= maxAccessStatsKeys {
+		return
+	}
+	accessCounts[cacheKey]++
+}
+
+// GCStats describes a single run of the cleanup of expired and unreadable cache entries.
+type GCStats struct {
+	RemovedCount int
+	TotalScanned int
+	BytesFreed   int64
+	Duration     time.Duration
+	// AuxiliaryRemoved is the number of removed stale auxiliary files, such as temporary files left
+	// behind by an interrupted Tx.
+	AuxiliaryRemoved int
+	// FirstError is the first error opening or removing a cache file. Such errors don't stop the run.
+	FirstError error
+}
+
+// gc scans the cache directory and removes outdated cache entries.
+// This ensures the cache stays lean and doesn't hoard expired data.
+func gc() {
+	_, _ = prune(context.Background())
+}
+
+// GC removes expired and unreadable cache entries, like the cleanup that runs on every Get and Set,
+// and reports what it did.
+//
+// Returns the statistics of the run and an error if listing the cache folder fails.
+//
+// Example:
+//
+//	stats, err := clicache.GC()
+//	if err != nil {
+//	  log.Fatalf("Failed to clean up cache: %v", err)
+//	}
+//	fmt.Printf("GC ran for %s, scanned %d entries, removed %d, freed %d bytes\n",
+//	  stats.Duration, stats.TotalScanned, stats.RemovedCount, stats.BytesFreed)
+func GC() (GCStats, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	return prune(context.Background())
+}
+
+// LastGCStats returns the statistics of the most recent cleanup in this process, whether it ran
+// through GC, PruneContext or the cleanup on Get and Set. It is the zero value if no cleanup ran yet.
+//
+// Example:
+//
+//	fmt.Println(clicache.LastGCStats().RemovedCount)
+func LastGCStats() GCStats {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	return lastGCStats
+}
+
+// PruneContext removes expired and unreadable cache entries, like the cleanup that runs on every
+// Get and Set, but stops as soon as ctx is done. This bounds maintenance time on large caches in
+// interactive CLIs; the remaining entries are cleaned up by a later run.
+//
+// ctx: Context bounding the operation.
+//
+// Returns the number of removed entries, and ctx.Err() if the operation was stopped early or an
+// error if listing the cache folder fails.
+//
+// Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+//	defer cancel()
+//	removed, err := clicache.PruneContext(ctx)
+func PruneContext(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	stats, err := prune(ctx)
+	return stats.RemovedCount, err
+}
+
+// prune removes expired and unreadable cache entries until ctx is done, and records the
+// statistics of the run for LastGCStats. The caller must hold cacheMutex.
+func prune(ctx context.Context) (stats GCStats, err error) {
+	start := time.Now()
+	defer func() {
+		stats.Duration = time.Since(start)
+		lastGCStats = stats
+	}()
+
+	files, err := getCacheFiles()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		stats.TotalScanned++
+		f, err := fs.Open(file)
+		if err != nil {
+			if stats.FirstError == nil && !fs.IsNotExist(err) {
+				stats.FirstError = err
+			}
+			continue
+		}
+
+		decoder := gob.NewDecoder(f)
+		var cacheItem CacheItem
+		err = decoder.Decode(&cacheItem)
+		inFlight := err != nil && isInFlightWrite(f, err)
+		var size int64
+		if stat, statErr := f.Stat(); statErr == nil {
+			size = stat.Size()
+		}
+		_ = f.Close()
+
+		if inFlight {
+			continue
+		}
+
+		if err != nil || time.Now().After(cacheItem.Expiration) {
+			removeErr := fs.Remove(file)
+			if removeErr == nil {
+				stats.RemovedCount++
+				stats.BytesFreed += size
+			} else if stats.FirstError == nil && !fs.IsNotExist(removeErr) {
+				stats.FirstError = removeErr
+			}
+		}
+	}
+
+	stats.AuxiliaryRemoved = pruneAuxiliaryFiles()
+
+	return stats, nil
+}
+
+// auxiliaryMaxAge is how long after its last modification an auxiliary file is considered left
+// behind by a crashed process, rather than still in use.
+const auxiliaryMaxAge = time.Hour
+
+// auxiliaryFilePatterns lists the glob patterns, following the cache file name, of the files clicache
+// writes next to cache files. gc and Cleanup remove stale files matching any of them.
+var auxiliaryFilePatterns = []string{
+	".*.tmp", // Entries staged by Tx.Set or copied by SwapFolder, see tempFileName.
+}
+
+// pruneAuxiliaryFiles removes auxiliary files in the cache folder that were not modified within
+// auxiliaryMaxAge. Errors are ignored. The caller must hold cacheMutex.
+//
+// Returns the number of removed files.
+func pruneAuxiliaryFiles() int {
+	removed := 0
+	for _, pattern := range auxiliaryFilePatterns {
+		files, err := fs.Glob(filepath.Join(cacheFolder, cachePrefix+"*.gob"+pattern))
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			f, err := fs.Open(file)
+			if err != nil {
+				continue
+			}
+			stat, err := f.Stat()
+			_ = f.Close()
+			if err != nil || time.Since(stat.ModTime()) < auxiliaryMaxAge {
+				continue
+			}
+
+			if fs.Remove(file) == nil {
+				removed++
+			}
+		}
+	}
+
+	return removed
+}
+
+// inFlightWriteWindow is how long after its last modification an empty or truncated cache file
+// is assumed to still be written by a concurrent Set rather than left behind by a crash.
+const inFlightWriteWindow = 5 * time.Second
+
+// isInFlightWrite reports whether the decode error err for the given cache file indicates a write
+// that is still in progress: the file is empty or ends early, and was modified very recently.
+// Such files are treated as a miss but not removed.
+func isInFlightWrite(file *os.File, err error) bool {
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false
+	}
+
+	stat, statErr := file.Stat()
+	if statErr != nil {
+		return false
+	}
+
+	return time.Since(stat.ModTime()) < inFlightWriteWindow
+}
+
+// Cleanup removes all cache entries, and auxiliary files such as temporary files of interrupted
+// transactions once they are stale. Errors are ignored; use CleanupContext to observe them.
+//
+// Example:
+//
+//	clicache.Cleanup()
+func Cleanup() {
+	_, _ = CleanupContext(context.Background())
+}
+
+// ForgetAll removes all cache entries. It is an alias for Cleanup, provided alongside Forget.
+//
+// Example:
+//
+//	clicache.ForgetAll()
+func ForgetAll() {
+	Cleanup()
+}
+
+// CleanupContext removes all cache entries like Cleanup, but stops as soon as ctx is done.
+//
+// ctx: Context bounding the operation.
+//
+// Returns the number of removed entries, and ctx.Err() if the operation was stopped early or an
+// error if listing the cache folder fails.
+//
+// Example:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+//	defer cancel()
+//	removed, err := clicache.CleanupContext(ctx)
+func CleanupContext(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	files, err := getCacheFiles()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+
+		if fs.Remove(file) == nil {
+			removed++
+		}
+	}
+	pruneAuxiliaryFiles()
+
+	return removed, nil
+}
+
+// CleanupDir removes all cache files with the given prefix from the given directory.
+// Unlike Cleanup, it is not tied to the configured cache folder and prefix, which makes it
+// useful for uninstall scripts or for removing caches left behind by other versions of a tool.
+// Only files named like cache files, i.e. the prefix followed by a cache key and ".gob", are removed.
+//
+// dir: Directory containing the cache files.
+// prefix: Cache file name prefix, e.g. "cli_cache_". It must not be empty.
+//
+// Returns the number of removed files, ErrInvalidPrefix if the prefix is empty or contains path
+// separators or glob metacharacters, and an error if the operation fails.
+//
+// Example:
+//
+//	removed, err := clicache.CleanupDir("/tmp", "cli_cache_")
+//	if err != nil {
+//	  log.Fatalf("Failed to cleanup cache directory: %v", err)
+//	}
+func CleanupDir(dir string, prefix string) (int, error) {
+	if !isValidFilePrefix(prefix) {
+		return 0, ErrInvalidPrefix
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	files, err := fs.Glob(filepath.Join(dir, prefix+"*.gob"))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, file := range files {
+		if !isCacheFileName(filepath.Base(file), prefix) {
+			continue
+		}
+
+		err := fs.Remove(file)
+		if err != nil {
+			if fs.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// isValidFilePrefix reports whether prefix can be used to match cache files: it must not be empty
+// and must not contain path separators or glob metacharacters.
+func isValidFilePrefix(prefix string) bool {
+	return prefix != "" && !strings.ContainsAny(prefix, `/\*?[`)
+}
+
+// isCacheFileName reports whether name is the name of a cache file with the given prefix, i.e. the
+// prefix followed by a cache key and ".gob".
+func isCacheFileName(name, prefix string) bool {
+	key, ok := strings.CutPrefix(name, prefix)
+	if !ok {
+		return false
+	}
+	key, ok = strings.CutSuffix(key, ".gob")
+	return ok && isValidToken(key)
+}
+
+// SweepForeignPrefixes removes cache files left in the cache folder under earlier prefixes, which
+// are otherwise orphaned after a prefix change because gc and Cleanup only match the current one.
+// Files matching the current prefix are never removed, even if an old prefix also matches them, and
+// only files named like cache files, i.e. the prefix followed by a cache key and ".gob", are removed.
+//
+// prefixes: Cache file name prefixes used by earlier versions, e.g. "mytool_v1_".
+//
+// Returns the number of removed files, ErrInvalidPrefix if a prefix is empty or contains path
+// separators or glob metacharacters, and an error if the operation fails. Prefixes are validated
+// before any file is removed.
+//
+// Example:
+//
+//	removed, err := clicache.SweepForeignPrefixes([]string{"mytool_v1_"})
+//	if err != nil {
+//	  log.Fatalf("Failed to sweep old cache files: %v", err)
+//	}
+func SweepForeignPrefixes(prefixes []string) (int, error) {
+	for _, prefix := range prefixes {
+		if !isValidFilePrefix(prefix) {
+			return 0, ErrInvalidPrefix
+		}
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	removed := 0
+	for _, prefix := range prefixes {
+		files, err := fs.Glob(filepath.Join(cacheFolder, prefix+"*.gob"))
+		if err != nil {
+			return removed, err
+		}
+
+		for _, file := range files {
+			name := filepath.Base(file)
+			if strings.HasPrefix(name, cachePrefix) || !isCacheFileName(name, prefix) {
+				continue
+			}
+
+			err := fs.Remove(file)
+			if err != nil {
+				if fs.IsNotExist(err) {
+					continue
+				}
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// Usage returns the number of cache files and their total size in bytes, including expired
+// entries not yet cleaned up. Only the list of files is taken under the cache lock; the files are
+// then inspected without holding it, so other operations are not blocked on large caches. The result
+// is therefore approximate when the cache is modified concurrently: files removed during the scan
+// are skipped and files added during the scan are not counted.
+//
+// Returns the number of files, their total size, and an error if listing the cache folder fails.
+//
+// Example:
+//
+//	count, size, err := clicache.Usage()
+//	if err != nil {
+//	  log.Fatalf("Failed to compute cache usage: %v", err)
+//	}
+//	fmt.Printf("%d entries, %d bytes\n", count, size)
+func Usage() (int, int64, error) {
+	cacheMutex.Lock()
+	files, err := getCacheFiles()
+	fileSystem := fs
+	cacheMutex.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count := 0
+	var size int64
 	for _, file := range files {
-		_, err := fs.Open(file)
+		f, err := fileSystem.Open(file)
+		if err != nil {
+			continue
+		}
+		stat, err := f.Stat()
+		_ = f.Close()
 		if err != nil {
 			continue
 		}
 
-		_ = fs.Remove(file)
+		count++
+		size += stat.Size()
+	}
+
+	return count, size, nil
+}
+
+// EntryCount returns the number of live and expired cache entries. Expired entries are removed by
+// the cleanup that runs on every Get and Set, so a large expired count means that cleanup is not
+// keeping up; a warning is logged through log/slog when there are more than twice as many expired
+// entries as live ones. Unreadable entries are not counted.
+//
+// Returns the live and expired counts and an error if listing the cache folder fails.
+//
+// Example:
+//
+//	live, expired, err := clicache.EntryCount()
+//	if err != nil {
+//	  log.Fatalf("Failed to count cache entries: %v", err)
+//	}
+//	fmt.Printf("%d live, %d expired\n", live, expired)
+func EntryCount() (int, int, error) {
+	cacheMutex.Lock()
+	files, err := getCacheFiles()
+	cacheMutex.Unlock()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	now := time.Now()
+	live, expired := 0, 0
+	for _, file := range files {
+		info, ok := readEntryInfo(file)
+		if !ok {
+			continue
+		}
+
+		if now.After(info.Expiration) {
+			expired++
+		} else {
+			live++
+		}
+	}
+
+	if expired > live*2 {
+		slog.Warn("clicache: expired entries are not being cleaned up", "live", live, "expired", expired)
+	}
+
+	return live, expired, nil
+}
+
+// ExportToMap returns all live cache entries in a form that can be serialized without knowing
+// the cached types, e.g. as JSON. Each key is a cache key, and each value is a map holding the
+// entry's "data" and its "expires" time. The data is JSON-encoded as a json.RawMessage, or
+// formatted with fmt's %v verb if it cannot be encoded as JSON.
+//
+// Returns the exported entries and an error if listing the cache folder fails.
+//
+// Example:
+//
+//	entries, err := clicache.ExportToMap()
+//	if err != nil {
+//	  log.Fatalf("Failed to export cache: %v", err)
+//	}
+//	_ = json.NewEncoder(os.Stdout).Encode(entries)
+func ExportToMap() (map[string]interface{}, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	files, err := getCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]interface{}, len(files))
+	for _, file := range files {
+		cacheItem, err := readCacheItem(file)
+		if err != nil || time.Now().After(cacheItem.Expiration) {
+			continue
+		}
+
+		var data interface{} = json.RawMessage(cacheItem.JSONData)
+		if len(cacheItem.JSONData) == 0 {
+			encoded, err := json.Marshal(cacheItem.Data)
+			if err != nil {
+				data = fmt.Sprintf("%v", cacheItem.Data)
+			} else {
+				data = json.RawMessage(encoded)
+			}
+		}
+
+		entries[getCacheKeyFromFileName(file)] = map[string]interface{}{
+			"data":    data,
+			"expires": cacheItem.Expiration,
+		}
+	}
+
+	return entries, nil
+}
+
+// QueryResult is a cache entry returned by Query.
+type QueryResult struct {
+	Key  string
+	Args []string
+	Data interface{}
+}
+
+// Query returns all live cache entries whose arguments start with the given prefix, together with
+// their data. Arguments are only recorded while SetStoreArgs is enabled; other entries only match an
+// empty prefix. Entries that cannot be decoded are skipped.
+//
+// prefix: Leading arguments the entries must share.
+//
+// Returns the matching entries in cache key order and an error if listing the cache folder fails.
+//
+// Example:
+//
+//	results, err := clicache.Query([]string{"status"})
+//	for _, r := range results {
+//	  fmt.Println(r.Args, r.Data)
+//	}
+func Query(prefix []string) ([]QueryResult, error) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	files, err := getCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []QueryResult
+	for _, file := range files {
+		cacheItem, err := readCacheItem(file)
+		if err != nil || time.Now().After(cacheItem.Expiration) || !hasArgsPrefix(cacheItem.Args, prefix) {
+			continue
+		}
+
+		var data interface{}
+		if decodeData(cacheItem, &data) != nil {
+			continue
+		}
+
+		results = append(results, QueryResult{
+			Key:  getCacheKeyFromFileName(file),
+			Args: cacheItem.Args,
+			Data: data,
+		})
+	}
+
+	return results, nil
+}
+
+// hasArgsPrefix reports whether args start with prefix.
+func hasArgsPrefix(args []string, prefix []string) bool {
+	if len(args) < len(prefix) {
+		return false
+	}
+	for i, arg := range prefix {
+		if args[i] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+// EntryInfo describes a cache entry without its data.
+//
+// Its JSON encoding is stable: the field names given in the json tags are not renamed or removed
+// within a major version, and new fields are only added. Times are encoded in RFC 3339 format, and
+// Created is the zero time for entries written before creation times were recorded.
+type EntryInfo struct {
+	Key        string    `json:"key"`
+	Expiration time.Time `json:"expiration"`
+	Created    time.Time `json:"created"`
+	// Size is the size of the cache file in bytes.
+	Size       int64  `json:"size"`
+	Provenance string `json:"provenance"`
+	// Embedded reports whether the entry is read from the layer set with SetEmbeddedFS rather
+	// than from the cache folder.
+	Embedded bool `json:"embedded"`
+}
+
+// entryFile is a cache file in the cache folder or, if embedded is set, in the embedded layer.
+type entryFile struct {
+	name     string
+	embedded bool
+}
+
+// getEntryFiles returns the cache files in the cache folder, sorted, followed by the sorted cache
+// files of the embedded layer whose keys have no cache file in the folder, which shadows them.
+// The caller must hold cacheMutex.
+func getEntryFiles() ([]entryFile, error) {
+	files, err := getCacheFiles()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	entries := make([]entryFile, 0, len(files))
+	keys := make(map[string]bool, len(files))
+	for _, file := range files {
+		entries = append(entries, entryFile{name: file})
+		keys[getCacheKeyFromFileName(file)] = true
+	}
+
+	if embeddedFS == nil {
+		return entries, nil
+	}
+	embedded, err := iofs.Glob(embeddedFS, path.Join(embeddedDir, cachePrefix+"*.gob"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(embedded)
+	for _, file := range embedded {
+		if !keys[getCacheKeyFromFileName(file)] {
+			entries = append(entries, entryFile{name: file, embedded: true})
+		}
+	}
+
+	return entries, nil
+}
+
+// StreamList walks the cache folder and the embedded layer set with SetEmbeddedFS, and calls fn for
+// each readable cache entry, including expired ones. Entries in the cache folder shadow embedded
+// entries with the same key. Unlike building a full listing, only one entry is held in memory at a time.
+// Iteration stops at the first error returned by fn, which is returned to the caller.
+//
+// fn: Function called with the information of each cache entry.
+//
+// Returns an error if listing the cache folder fails or fn returns an error.
+//
+// Example:
+//
+//	err := clicache.StreamList(func(info clicache.EntryInfo) error {
+//	  fmt.Println(info.Key, info.Expiration)
+//	  return nil
+//	})
+func StreamList(fn func(EntryInfo) error) error {
+	cacheMutex.Lock()
+	files, err := getEntryFiles()
+	cacheMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		info, ok := readEntryFileInfo(file)
+		if !ok {
+			continue
+		}
+
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Scan returns the information of up to count cache entries, starting at cursor, for paginated
+// listings. Start with cursor 0 and pass the returned cursor to the next call; a returned cursor
+// of 0 means the scan is complete. Cursors are positions in the sorted list of cache files, so
+// entries added or removed during a scan may be skipped or returned twice. Entries of the embedded
+// layer follow those of the cache folder, as in StreamList. Unreadable entries are skipped. A count
+// of 0 or less defaults to 10.
+//
+// cursor: Position to continue from, 0 to start.
+// count: Maximum number of entries to return.
+//
+// Returns the entries, the cursor for the next call, and an error if listing the cache folder fails.
+//
+// Example:
+//
+//	cursor := 0
+//	for {
+//	  entries, next, err := clicache.Scan(cursor, 20)
+//	  if err != nil {
+//	    log.Fatalf("Failed to scan cache: %v", err)
+//	  }
+//	  render(entries)
+//	  if next == 0 {
+//	    break
+//	  }
+//	  cursor = next
+//	}
+func Scan(cursor int, count int) ([]EntryInfo, int, error) {
+	if cursor < 0 {
+		return nil, 0, fmt.Errorf("clicache: invalid scan cursor %d", cursor)
+	}
+	if count <= 0 {
+		count = 10
+	}
+
+	cacheMutex.Lock()
+	files, err := getEntryFiles()
+	cacheMutex.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var entries []EntryInfo
+	for cursor < len(files) && len(entries) < count {
+		if info, ok := readEntryFileInfo(files[cursor]); ok {
+			entries = append(entries, info)
+		}
+		cursor++
+	}
+
+	if cursor >= len(files) {
+		return entries, 0, nil
+	}
+
+	return entries, cursor, nil
+}
+
+// ListByTTLRange returns the cache entries whose remaining TTL lies between minRemaining and
+// maxRemaining (inclusive), sorted by remaining TTL in ascending order. Expired entries have a
+// negative remaining TTL and are only included if minRemaining is negative.
+//
+// minRemaining: Minimum remaining TTL.
+// maxRemaining: Maximum remaining TTL.
+//
+// Returns the matching entries and an error if listing the cache fails.
+//
+// Example:
+//
+//	// Find entries expiring within the next 10 minutes to warm them proactively.
+//	entries, err := clicache.ListByTTLRange(0, 10*time.Minute)
+//	if err != nil {
+//	  log.Fatalf("Failed to list cache: %v", err)
+//	}
+func ListByTTLRange(minRemaining, maxRemaining time.Duration) ([]EntryInfo, error) {
+	now := time.Now()
+
+	var entries []EntryInfo
+	err := StreamList(func(info EntryInfo) error {
+		remaining := info.Expiration.Sub(now)
+		if remaining >= minRemaining && remaining <= maxRemaining {
+			entries = append(entries, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Expiration.Before(entries[j].Expiration)
+	})
+
+	return entries, nil
+}
+
+// ExpiringWithin returns the live cache entries that expire within d, sorted soonest first, e.g. for
+// a job that refreshes entries before users run into misses. Expired entries are not included.
+//
+// d: Time window from now.
+//
+// Returns the matching entries and an error if listing the cache fails.
+//
+// Example:
+//
+//	entries, err := clicache.ExpiringWithin(time.Hour)
+//	if err != nil {
+//	  log.Fatalf("Failed to list cache: %v", err)
+//	}
+func ExpiringWithin(d time.Duration) ([]EntryInfo, error) {
+	return ListByTTLRange(0, d)
+}
+
+// readEntryInfo reads the information of the cache entry stored in the given file.
+// It reports false if the file cannot be opened or decoded.
+func readEntryInfo(file string) (EntryInfo, bool) {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	f, err := fs.Open(file)
+	if err != nil {
+		return EntryInfo{}, false
+	}
+	defer f.Close()
+
+	return decodeEntryInfo(file, f)
+}
+
+// readEntryFileInfo reads the information of the cache entry stored in the given file of the cache
+// folder or the embedded layer. It reports false if the file cannot be opened or decoded.
+func readEntryFileInfo(file entryFile) (EntryInfo, bool) {
+	if !file.embedded {
+		return readEntryInfo(file.name)
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	if embeddedFS == nil {
+		return EntryInfo{}, false
+	}
+	f, err := embeddedFS.Open(file.name)
+	if err != nil {
+		return EntryInfo{}, false
+	}
+	defer f.Close()
+
+	info, ok := decodeEntryInfo(file.name, f)
+	info.Embedded = true
+	return info, ok
+}
+
+// decodeEntryInfo decodes the information of the cache entry read from f, which was opened from
+// the given file.
+func decodeEntryInfo(file string, f iofs.File) (EntryInfo, bool) {
+	var cacheItem CacheItem
+	if err := gob.NewDecoder(f).Decode(&cacheItem); err != nil {
+		return EntryInfo{}, false
+	}
+
+	info := EntryInfo{
+		Key:        getCacheKeyFromFileName(file),
+		Expiration: cacheItem.Expiration,
+		Created:    cacheItem.Created,
+		Provenance: cacheItem.Provenance,
+	}
+	if stat, err := f.Stat(); err == nil {
+		info.Size = stat.Size()
+	}
+
+	return info, true
+}
+
+// SetWatchInterval sets how often Watch polls cache entries for changes. The default is one second.
+// Non-positive intervals are rejected and leave the current interval unchanged.
+//
+// d: Poll interval. It must be greater than zero.
+//
+// Returns an error if d is not greater than zero.
+//
+// Example:
+//
+//	if err := clicache.SetWatchInterval(100 * time.Millisecond); err != nil {
+//	  log.Fatalf("Failed to set watch interval: %v", err)
+//	}
+func SetWatchInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("clicache: invalid watch interval %v", d)
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	watchInterval = d
+	return nil
+}
+
+// Watch polls the cache file associated with the provided CLI arguments and calls fn with the
+// decoded cache item whenever its modification time changes, e.g. because another process updated
+// the entry. Polling uses the interval set by SetWatchInterval and runs until cancel is called.
+// Removals and unreadable entries are not reported.
+//
+// args: Command line arguments which determine the cache key.
+// fn: Function called with the updated cache item.
+//
+// Returns a function that stops watching, and an error if the entry cannot be inspected.
+//
+// Example:
+//
+//	cancel, err := clicache.Watch([]string{"config"}, func(item clicache.CacheItem) {
+//	  fmt.Println("Config updated:", item.Data)
+//	})
+//	if err != nil {
+//	  log.Fatalf("Failed to watch cache: %v", err)
+//	}
+//	defer cancel()
+func Watch(args []string, fn func(CacheItem)) (func(), error) {
+	cacheMutex.Lock()
+	cacheFile := getCacheFileName(generateCacheKey(args))
+	interval := watchInterval
+	lastModTime, _, err := statCacheItem(cacheFile)
+	cacheMutex.Unlock()
+	if err != nil && !fs.IsNotExist(err) {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			cacheMutex.Lock()
+			modTime, cacheItem, err := statCacheItem(cacheFile)
+			cacheMutex.Unlock()
+			if err != nil || modTime.Equal(lastModTime) {
+				continue
+			}
+
+			lastModTime = modTime
+			fn(cacheItem)
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+// statCacheItem returns the modification time and decoded cache item of the given file.
+// The caller must hold cacheMutex.
+func statCacheItem(cacheFile string) (time.Time, CacheItem, error) {
+	file, err := fs.Open(cacheFile)
+	if err != nil {
+		return time.Time{}, CacheItem{}, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return time.Time{}, CacheItem{}, err
+	}
+
+	cacheItem, err := decodeCacheItem(file)
+	if err != nil {
+		return time.Time{}, CacheItem{}, err
 	}
+
+	err = decodeData(cacheItem, &cacheItem.Data)
+	cacheItem.JSONData = nil
+
+	return stat.ModTime(), cacheItem, err
 }
@@ -1,11 +1,26 @@
 package clicache
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"flag"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
+
+	"github.com/yarlson/clicache/internal/legacygen"
 )
 
 func TestGet(t *testing.T) {
@@ -124,6 +139,13 @@ func TestSet(t *testing.T) {
 }
 
 func TestSetTTL(t *testing.T) {
+	var buf strings.Builder
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+	defer ResetDeprecationWarnings()
+	ResetDeprecationWarnings()
+
 	type args struct {
 		ttl int
 	}
@@ -141,8 +163,33 @@ func TestSetTTL(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			SetTTL(tt.args.ttl)
-			if cacheTTL != tt.args.ttl {
-				t.Errorf("SetTTL() = %v, want %v", cacheTTL, tt.args.ttl)
+			if want := time.Duration(tt.args.ttl) * time.Second; cacheTTL != want {
+				t.Errorf("SetTTL() = %v, want %v", cacheTTL, want)
+			}
+		})
+	}
+
+	SetTTL(1)
+	if got := strings.Count(buf.String(), "deprecation=set-ttl"); got != 1 {
+		t.Errorf("SetTTL() deprecation warnings logged = %d, want 1", got)
+	}
+}
+
+func TestSetTTLDuration(t *testing.T) {
+	defer SetTTLDuration(cacheTTL)
+
+	tests := []struct {
+		name string
+		ttl  time.Duration
+	}{
+		{"seconds", 90 * time.Second},
+		{"sub-second", 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetTTLDuration(tt.ttl)
+			if ttl, _ := ResolveTTL([]string{"command"}); ttl != tt.ttl {
+				t.Errorf("SetTTLDuration() = %v, want %v", ttl, tt.ttl)
 			}
 		})
 	}
@@ -170,3 +217,3067 @@ func TestCleanup(t *testing.T) {
 		})
 	}
 }
+
+func TestGetOrSetContext(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "get-or-set"}
+	calls := 0
+	fn := func(ctx context.Context) (string, error) {
+		calls++
+		return "This is data.", nil
+	}
+
+	for i := 0; i < 2; i++ {
+		out, err := GetOrSetContext(context.Background(), args, time.Minute, fn)
+		if err != nil {
+			t.Fatalf("GetOrSetContext() error = %v", err)
+		}
+		if out != "This is data." {
+			t.Fatalf("GetOrSetContext() = %v, want %v", out, "This is data.")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, want 1", calls)
+	}
+
+	_, err := GetOrSetContext(context.Background(), args, time.Minute, func(ctx context.Context) (int, error) {
+		return 42, nil
+	})
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetOrSetContext() with different type error = %v, want %v", err, ErrTypeMismatch)
+	}
+	if cached, _, _ := Get(args); cached != "This is data." {
+		t.Errorf("GetOrSetContext() with different type overwrote the entry with %v", cached)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GetOrSetContext(ctx, args, time.Minute, fn); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetOrSetContext() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+
+	_, err = GetOrSetContext(context.Background(), []string{"command", "failing"}, time.Minute,
+		func(ctx context.Context) (string, error) {
+			return "", errors.New("error")
+		})
+	if err == nil {
+		t.Error("GetOrSetContext() should return the error from fn")
+	}
+}
+
+func TestSetMaxAge(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetMaxAge(0)
+
+	args := []string{"command", "max-age"}
+	if err := Set(args, "This is cached data.", 3600); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	SetMaxAge(time.Hour)
+	if _, found, err := Get(args); !found || err != nil {
+		t.Fatalf("Get() found = %v, err = %v, want entry within max age", found, err)
+	}
+
+	SetMaxAge(50 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	_, found, err := Get(args)
+	if err != nil {
+		t.Fatalf("Failed to get cache: %v", err)
+	}
+	if found {
+		t.Fatal("Cache entry older than max age should be treated as stale")
+	}
+}
+
+func TestSetKeyPreprocessor(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetKeyPreprocessor(nil)
+
+	SetKeyPreprocessor(func(args []string) []string {
+		var out []string
+		for _, arg := range args {
+			if !strings.HasPrefix(arg, "--request-id=") {
+				out = append(out, arg)
+			}
+		}
+		return out
+	})
+
+	if err := Set([]string{"command", "--request-id=abc"}, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	cachedData, found, err := Get([]string{"command", "--request-id=def"})
+	if err != nil || !found {
+		t.Fatalf("Get() found = %v, err = %v, want preprocessed args to hit", found, err)
+	}
+	if cachedData != "This is cached data." {
+		t.Errorf("Get() = %v, want %v", cachedData, "This is cached data.")
+	}
+}
+
+func TestSetDataSanitizer(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetDataSanitizer(nil)
+
+	SetDataSanitizer(func(data interface{}) interface{} {
+		return strings.TrimSpace(data.(string))
+	})
+
+	args := []string{"command", "sanitized"}
+	if err := Set(args, "  This is cached data.\n", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	cachedData, _, err := Get(args)
+	if err != nil {
+		t.Fatalf("Failed to get cache: %v", err)
+	}
+	if cachedData != "This is cached data." {
+		t.Errorf("Get() = %q, want %q", cachedData, "This is cached data.")
+	}
+}
+
+func TestStreamList(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	for _, arg := range []string{"a", "b", "c"} {
+		if err := Set([]string{"command", arg}, "This is cached data.", 10); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+	}
+
+	keys := make(map[string]bool)
+	err := StreamList(func(info EntryInfo) error {
+		keys[info.Key] = true
+		if info.Size == 0 {
+			t.Errorf("StreamList() entry %s has zero size", info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamList() error = %v", err)
+	}
+	for _, arg := range []string{"a", "b", "c"} {
+		if key := generateCacheKey([]string{"command", arg}); !keys[key] {
+			t.Errorf("StreamList() did not visit entry %s", key)
+		}
+	}
+
+	calls := 0
+	stop := errors.New("stop")
+	err = StreamList(func(info EntryInfo) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("StreamList() error = %v, want %v", err, stop)
+	}
+	if calls != 1 {
+		t.Errorf("StreamList() called fn %d times after error, want 1", calls)
+	}
+}
+
+func TestSetArgCanonicalizer(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetArgCanonicalizer(nil)
+
+	SetArgCanonicalizer(strings.ToLower)
+
+	if err := Set([]string{"command", "--Region", "EU"}, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	cachedData, found, err := Get([]string{"command", "--region", "eu"})
+	if err != nil || !found {
+		t.Fatalf("Get() found = %v, err = %v, want canonicalized args to hit", found, err)
+	}
+	if cachedData != "This is cached data." {
+		t.Errorf("Get() = %v, want %v", cachedData, "This is cached data.")
+	}
+}
+
+func TestCleanupDir(t *testing.T) {
+	fs = OSFileSystem{}
+	dir := t.TempDir()
+
+	key := HashArgs([]string{"command", "cleanup-dir"})
+	names := []string{"old_cache_" + key + ".gob", "old_cache_status_" + key + ".gob", "old_cache_notes.gob", "other_" + key + ".gob"}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	for _, prefix := range []string{"", "*", "../old_cache_"} {
+		if _, err := CleanupDir(dir, prefix); !errors.Is(err, ErrInvalidPrefix) {
+			t.Errorf("CleanupDir(%q) error = %v, want ErrInvalidPrefix", prefix, err)
+		}
+	}
+
+	removed, err := CleanupDir(dir, "old_cache_")
+	if err != nil {
+		t.Fatalf("CleanupDir() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("CleanupDir() removed = %d, want 2", removed)
+	}
+	for _, name := range names[2:] {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("CleanupDir() should keep %s: %v", name, err)
+		}
+	}
+}
+
+func TestSetWithDeps(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	depArgs := []string{"command", "source"}
+	args := []string{"command", "derived"}
+
+	if err := Set(depArgs, "v1", 10); err != nil {
+		t.Fatalf("Failed to set dependency: %v", err)
+	}
+	if err := SetWithDeps(args, "derived from v1", 10, [][]string{depArgs}); err != nil {
+		t.Fatalf("SetWithDeps() error = %v", err)
+	}
+
+	if _, found, err := Get(args); !found || err != nil {
+		t.Fatalf("Get() found = %v, err = %v, want hit while dependency is unchanged", found, err)
+	}
+
+	if err := Set(depArgs, "v2", 10); err != nil {
+		t.Fatalf("Failed to update dependency: %v", err)
+	}
+	if _, found, err := Get(args); found || err != nil {
+		t.Fatalf("Get() found = %v, err = %v, want miss after dependency changed", found, err)
+	}
+
+	if err := SetWithDeps(args, "derived from v2", 10, [][]string{depArgs}); err != nil {
+		t.Fatalf("SetWithDeps() error = %v", err)
+	}
+	cachedData, found, err := Get(args)
+	if !found || err != nil {
+		t.Fatalf("Get() found = %v, err = %v, want hit after recompute", found, err)
+	}
+	if cachedData != "derived from v2" {
+		t.Errorf("Get() = %v, want %v", cachedData, "derived from v2")
+	}
+}
+
+func TestHashArgs(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "arg1", "arg2"}
+	if err := Set(args, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(cacheFolder, cachePrefix+HashArgs(args)+".gob")); err != nil {
+		t.Errorf("HashArgs() does not match the cache file written by Set: %v", err)
+	}
+}
+
+func TestSetConflictPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        ConflictPolicy
+		wantErrs      int
+		wantOverwrite bool
+	}{
+		{
+			name:          "LastWriteWins",
+			policy:        LastWriteWins,
+			wantErrs:      0,
+			wantOverwrite: true,
+		},
+		{
+			name:          "FirstWriteWins",
+			policy:        FirstWriteWins,
+			wantErrs:      0,
+			wantOverwrite: false,
+		},
+		{
+			name:          "Reject",
+			policy:        Reject,
+			wantErrs:      9,
+			wantOverwrite: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = OSFileSystem{}
+			Cleanup()
+			defer Cleanup()
+			SetConflictPolicy(tt.policy)
+			defer SetConflictPolicy(LastWriteWins)
+
+			args := []string{"command", "conflict"}
+			errs := make(chan error, 10)
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- Set(args, i, 10)
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			gotErrs := 0
+			for err := range errs {
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, ErrEntryExists) {
+					t.Fatalf("Set() error = %v, want %v", err, ErrEntryExists)
+				}
+				gotErrs++
+			}
+			if gotErrs != tt.wantErrs {
+				t.Errorf("Set() returned %d errors, want %d", gotErrs, tt.wantErrs)
+			}
+
+			if err := Set(args, -1, 10); (err != nil) != (tt.policy == Reject) {
+				t.Errorf("Set() on existing entry error = %v", err)
+			}
+			cachedData, _, _ := Get(args)
+			if got := cachedData == -1; got != tt.wantOverwrite {
+				t.Errorf("Get() = %v, overwritten = %v, want %v", cachedData, got, tt.wantOverwrite)
+			}
+		})
+	}
+}
+
+func TestRateLimitedCache(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	// Cache keys on flag.Args, which is empty under go test.
+	SetAllowEmptyKey(true)
+	defer SetAllowEmptyKey(false)
+
+	cache := RateLimitedCache(1)
+	calls := 0
+	handler := func() (string, error) {
+		calls++
+		return "This is data.", nil
+	}
+
+	if _, err := cache(handler); err != nil {
+		t.Fatalf("RateLimitedCache() error = %v", err)
+	}
+	// Hits are served without consuming the rate.
+	if _, err := cache(handler); err != nil {
+		t.Fatalf("RateLimitedCache() hit error = %v", err)
+	}
+
+	Cleanup()
+	if _, err := cache(handler); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("RateLimitedCache() error = %v, want %v", err, ErrRateLimited)
+	}
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
+
+func TestRateLimitedCacheUnlimited(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	SetAllowEmptyKey(true)
+	defer SetAllowEmptyKey(false)
+
+	for _, maxRPS := range []int{0, -1} {
+		cache := RateLimitedCache(maxRPS)
+		for i := 0; i < 3; i++ {
+			Cleanup()
+			if _, err := cache(func() (string, error) { return "This is data.", nil }); err != nil {
+				t.Errorf("RateLimitedCache(%d) call %d error = %v, want nil", maxRPS, i, err)
+			}
+		}
+	}
+}
+
+func TestAccessStats(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "frequent"}
+	if err := Set(args, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	before := AccessStats()[HashArgs(args)]
+	for i := 0; i < 3; i++ {
+		if _, found, err := Get(args); !found || err != nil {
+			t.Fatalf("Get() found = %v, err = %v", found, err)
+		}
+	}
+	_, _, _ = Get([]string{"command", "missing"})
+
+	stats := AccessStats()
+	if got := stats[HashArgs(args)] - before; got != 3 {
+		t.Errorf("AccessStats() recorded %d hits, want 3", got)
+	}
+	if _, ok := stats[HashArgs([]string{"command", "missing"})]; ok {
+		t.Error("AccessStats() should not record misses")
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	args := []string{"command", "exactly-once"}
+	run := func() int {
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			computed int
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, ok, err := GetOrSet(args, 1, func() (interface{}, error) {
+					return "This is data.", nil
+				})
+				if err != nil {
+					t.Errorf("GetOrSet() error = %v", err)
+				}
+				if data != "This is data." {
+					t.Errorf("GetOrSet() = %v, want %v", data, "This is data.")
+				}
+				if ok {
+					mu.Lock()
+					computed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return computed
+	}
+
+	if computed := run(); computed != 1 {
+		t.Errorf("GetOrSet() computed = true for %d callers, want 1", computed)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if computed := run(); computed != 1 {
+		t.Errorf("GetOrSet() after expiry computed = true for %d callers, want 1", computed)
+	}
+
+	if len(keyLocks) != 0 {
+		t.Errorf("keyLocks holds %d locks after all callers returned, want 0", len(keyLocks))
+	}
+}
+
+func TestSetJSONFallback(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetJSONFallback(false)
+
+	type unregistered struct {
+		Name  string
+		Count int
+	}
+	args := []string{"command", "unregistered"}
+
+	if err := Set(args, unregistered{Name: "a", Count: 1}, 10); err == nil {
+		t.Fatal("Set() should fail for an unregistered type without the JSON fallback")
+	}
+
+	SetJSONFallback(true)
+	if err := Set(args, unregistered{Name: "a", Count: 1}, 10); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	cachedData, found, err := Get(args)
+	if err != nil || !found {
+		t.Fatalf("Get() found = %v, err = %v", found, err)
+	}
+	want := map[string]interface{}{"Name": "a", "Count": float64(1)}
+	if !reflect.DeepEqual(cachedData, want) {
+		t.Errorf("Get() = %#v, want %#v", cachedData, want)
+	}
+}
+
+func TestDecodeAs(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	type user struct {
+		Name string
+	}
+	gob.Register(user{})
+
+	args := []string{"command", "decode-as"}
+	if err := Set(args, user{Name: "a"}, 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	var got user
+	found, err := DecodeAs(args, &got)
+	if err != nil || !found {
+		t.Fatalf("DecodeAs() found = %v, err = %v", found, err)
+	}
+	if got.Name != "a" {
+		t.Errorf("DecodeAs() = %+v, want %+v", got, user{Name: "a"})
+	}
+
+	var wrongType string
+	if _, err := DecodeAs(args, &wrongType); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("DecodeAs() error = %v, want %v", err, ErrTypeMismatch)
+	}
+
+	found, err = DecodeAs([]string{"command", "missing"}, &got)
+	if found || err != nil {
+		t.Errorf("DecodeAs() found = %v, err = %v, want a miss", found, err)
+	}
+}
+
+func TestSetX(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	args := []string{"command", "set-x"}
+	for i, want := range []bool{false, true} {
+		overwrote, err := SetX(args, "This is cached data.", 10)
+		if err != nil {
+			t.Fatalf("SetX() error = %v", err)
+		}
+		if overwrote != want {
+			t.Errorf("SetX() call %d overwrote = %v, want %v", i+1, overwrote, want)
+		}
+	}
+}
+
+func TestSetXNoWrite(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+	defer SetConflictPolicy(LastWriteWins)
+	defer SetDisabled(false)
+
+	args := []string{"command", "set-x-no-write"}
+	if err := Set(args, "one", 10); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	SetConflictPolicy(FirstWriteWins)
+	overwrote, err := SetX(args, "two", 10)
+	if err != nil {
+		t.Fatalf("SetX() error = %v", err)
+	}
+	if overwrote {
+		t.Error("SetX() under FirstWriteWins overwrote = true, want false")
+	}
+	if data, found, _ := Get(args); !found || data != "one" {
+		t.Errorf("Get() = %v, %v, want one, true", data, found)
+	}
+
+	SetConflictPolicy(LastWriteWins)
+	SetDisabled(true)
+	overwrote, err = SetX(args, "three", 10)
+	if err != nil {
+		t.Fatalf("SetX() error = %v", err)
+	}
+	if overwrote {
+		t.Error("SetX() with caching disabled overwrote = true, want false")
+	}
+}
+
+func TestSetKeyEnv(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetKeyEnv()
+
+	SetKeyEnv("CLICACHE_TEST_PROFILE")
+	args := []string{"command", "env"}
+
+	t.Setenv("CLICACHE_TEST_PROFILE", "dev")
+	if err := Set(args, "dev data", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	if cachedData, found, _ := Get(args); !found || cachedData != "dev data" {
+		t.Fatalf("Get() = %v, %v, want hit for the same environment", cachedData, found)
+	}
+
+	t.Setenv("CLICACHE_TEST_PROFILE", "prod")
+	if _, found, _ := Get(args); found {
+		t.Error("Get() should miss when the environment variable changes")
+	}
+
+	t.Setenv("CLICACHE_TEST_PROFILE", "")
+	if err := Set(args, "empty data", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	os.Unsetenv("CLICACHE_TEST_PROFILE")
+	if _, found, _ := Get(args); found {
+		t.Error("Get() should distinguish an unset variable from an empty one")
+	}
+
+	t.Setenv("CLICACHE_TEST_PROFILE", "dev")
+	if cachedData, found, _ := Get(args); !found || cachedData != "dev data" {
+		t.Errorf("Get() = %v, %v, want hit after restoring the environment", cachedData, found)
+	}
+}
+
+func TestSetChecksum(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	SetChecksum(true)
+	defer SetChecksum(false)
+
+	args := []string{"command", "checksum"}
+	data := []string{"a", "b"}
+	if err := Set(args, data, 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	cachedData, found, err := Get(args)
+	if err != nil || !found {
+		t.Fatalf("Get() found = %v, err = %v", found, err)
+	}
+	if !reflect.DeepEqual(cachedData, data) {
+		t.Errorf("Get() = %v, want %v", cachedData, data)
+	}
+
+	cacheFile := getCacheFileName(HashArgs(args))
+	cacheItem, err := readCacheItem(cacheFile)
+	if err != nil {
+		t.Fatalf("Failed to read cache file: %v", err)
+	}
+	var tampered interface{} = []string{"c"}
+	cacheItem.Data = nil
+	cacheItem.Payload, _ = encodeGob(&tampered)
+	corrupted, err := encodeGob(&cacheItem)
+	if err != nil {
+		t.Fatalf("Failed to encode corrupted item: %v", err)
+	}
+	if err := os.WriteFile(cacheFile, corrupted, 0o600); err != nil {
+		t.Fatalf("Failed to write corrupted cache file: %v", err)
+	}
+
+	if _, _, err := Get(args); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Errorf("Get() should remove an entry with a checksum mismatch: %v", err)
+	}
+}
+
+func TestConfigureFromEnv(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetTTLDuration(cacheTTL)
+	defer SetDisabled(false)
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	t.Setenv("CLICACHE_TEST_CACHE_DIR", dir)
+	t.Setenv("CLICACHE_TEST_CACHE_TTL", "42")
+	t.Setenv("CLICACHE_TEST_CACHE_DISABLED", "true")
+
+	if err := ConfigureFromEnv("CLICACHE_TEST"); err != nil {
+		t.Fatalf("ConfigureFromEnv() error = %v", err)
+	}
+	if cacheFolder != dir {
+		t.Errorf("cacheFolder = %v, want %v", cacheFolder, dir)
+	}
+	if cacheTTL != 42*time.Second {
+		t.Errorf("cacheTTL = %v, want %v", cacheTTL, 42*time.Second)
+	}
+	if !cacheDisabled {
+		t.Error("cacheDisabled = false, want true")
+	}
+
+	args := []string{"command", "disabled"}
+	if err := Set(args, "This is cached data.", 10); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, found, _ := Get(args); found {
+		t.Error("Get() should miss while the cache is disabled")
+	}
+
+	for _, value := range []string{"0", "-1", "abc"} {
+		t.Setenv("CLICACHE_TEST_CACHE_TTL", value)
+		if err := ConfigureFromEnv("CLICACHE_TEST"); err == nil {
+			t.Errorf("ConfigureFromEnv() with TTL %q should return an error", value)
+		}
+	}
+
+	missing := filepath.Join(t.TempDir(), "not-created")
+	t.Setenv("CLICACHE_TEST_CACHE_DIR", missing)
+	t.Setenv("CLICACHE_TEST_CACHE_TTL", "42")
+	t.Setenv("CLICACHE_TEST_CACHE_DISABLED", "maybe")
+	if err := ConfigureFromEnv("CLICACHE_TEST"); err == nil {
+		t.Error("ConfigureFromEnv() with a malformed DISABLED value should return an error")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("ConfigureFromEnv() created the cache folder despite a malformed value: %v", err)
+	}
+}
+
+func TestAppendToCache(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "append"}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := AppendToCache(args, i, 0, time.Minute); err != nil {
+				t.Errorf("AppendToCache() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	cachedData, _, err := Get(args)
+	if err != nil {
+		t.Fatalf("Failed to get cache: %v", err)
+	}
+	if items := cachedData.([]interface{}); len(items) != 20 {
+		t.Errorf("AppendToCache() stored %d items, want 20", len(items))
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := AppendToCache(args, i, 2, time.Minute); err != nil {
+			t.Fatalf("AppendToCache() error = %v", err)
+		}
+	}
+	cachedData, _, _ = Get(args)
+	if items := cachedData.([]interface{}); !reflect.DeepEqual(items, []interface{}{1, 2}) {
+		t.Errorf("AppendToCache() with maxItems stored %v, want %v", items, []interface{}{1, 2})
+	}
+
+	if err := Set(args, "not a list", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	if err := AppendToCache(args, 1, 0, time.Minute); err == nil {
+		t.Error("AppendToCache() should return an error when the entry is not a list")
+	}
+}
+
+func TestSetWatchIntervalInvalid(t *testing.T) {
+	defer SetWatchInterval(time.Second)
+
+	for _, d := range []time.Duration{0, -time.Second} {
+		if err := SetWatchInterval(d); err == nil {
+			t.Errorf("SetWatchInterval(%v) should return an error", d)
+		}
+	}
+	if watchInterval != time.Second {
+		t.Errorf("watchInterval = %v, want it unchanged after invalid intervals", watchInterval)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	if err := SetWatchInterval(10 * time.Millisecond); err != nil {
+		t.Fatalf("SetWatchInterval() error = %v", err)
+	}
+	defer SetWatchInterval(time.Second)
+
+	args := []string{"command", "watched"}
+	updates := make(chan interface{}, 10)
+	cancel, err := Watch(args, func(item CacheItem) {
+		updates <- item.Data
+	})
+	if err != nil {
+		t.Fatalf("Watch() error = %v", err)
+	}
+
+	for _, data := range []string{"v1", "v2"} {
+		if err := Set(args, data, 10); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+		select {
+		case got := <-updates:
+			if got != data {
+				t.Errorf("Watch() reported %v, want %v", got, data)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Watch() did not report update to %v", data)
+		}
+	}
+
+	cancel()
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if err := Set(args, "v3", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	select {
+	case got := <-updates:
+		t.Errorf("Watch() reported %v after cancel", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSetPipeline(t *testing.T) {
+	defer Cleanup()
+
+	creates := 0
+	fs = &FileSystemMock{
+		CreateFunc: func(name string) (*os.File, error) {
+			creates++
+			if creates == 2 {
+				return nil, errors.New("disk failure")
+			}
+			return os.Create(name)
+		},
+		OpenFunc:       os.Open,
+		RemoveFunc:     os.Remove,
+		IsNotExistFunc: os.IsNotExist,
+		GlobFunc:       filepath.Glob,
+	}
+	defer func() { fs = OSFileSystem{} }()
+
+	pipe := NewSetPipeline()
+	for _, arg := range []string{"a", "b", "c"} {
+		pipe.Add([]string{"command", "pipeline", arg}, arg, 10)
+	}
+	if err := pipe.Execute(); err == nil {
+		t.Fatal("Execute() should return the write error")
+	}
+	for _, arg := range []string{"a", "b", "c"} {
+		if _, found, _ := Get([]string{"command", "pipeline", arg}); found {
+			t.Errorf("Execute() left entry %s after a failed write", arg)
+		}
+	}
+
+	fs = OSFileSystem{}
+	if err := pipe.Execute(); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	for _, arg := range []string{"a", "b", "c"} {
+		if cachedData, found, _ := Get([]string{"command", "pipeline", arg}); !found || cachedData != arg {
+			t.Errorf("Get() = %v, %v, want %v", cachedData, found, arg)
+		}
+	}
+}
+
+func TestSetPipelineRollbackRestores(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+	defer SetConflictPolicy(LastWriteWins)
+
+	existing := []string{"command", "pipeline", "existing"}
+	kept := []string{"command", "pipeline", "kept"}
+	fresh := []string{"command", "pipeline", "fresh"}
+	for _, args := range [][]string{existing, kept} {
+		if err := Set(args, "old", 10); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	pipe := NewSetPipeline()
+	pipe.Add(existing, "new", 10)
+	pipe.Add(fresh, "new", 10)
+	pipe.Add(existing, "newer", 10)
+	pipe.Add(kept, make(chan int), 10)
+	if err := pipe.Execute(); err == nil {
+		t.Fatal("Execute() should return the encoding error")
+	}
+
+	for _, args := range [][]string{existing, kept} {
+		if cachedData, found, _ := Get(args); !found || cachedData != "old" {
+			t.Errorf("Get(%v) = %v, %v, want old, true", args, cachedData, found)
+		}
+	}
+	if _, found, _ := Get(fresh); found {
+		t.Error("Execute() left a new entry after a failed write")
+	}
+
+	SetConflictPolicy(FirstWriteWins)
+	pipe = NewSetPipeline()
+	pipe.Add(kept, "skipped", 10)
+	pipe.Add(fresh, make(chan int), 10)
+	if err := pipe.Execute(); err == nil {
+		t.Fatal("Execute() should return the encoding error")
+	}
+	if cachedData, found, _ := Get(kept); !found || cachedData != "old" {
+		t.Errorf("Get() = %v, %v, want the entry skipped by the conflict policy to remain", cachedData, found)
+	}
+}
+
+func TestTx(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetConflictPolicy(LastWriteWins)
+
+	keys := [][]string{{"tx", "summary"}, {"tx", "detail"}, {"tx", "index"}}
+	stage := func(t *testing.T) *Tx {
+		t.Helper()
+		tx := Begin()
+		for _, args := range keys {
+			if err := tx.Set(args, args[1], 60); err != nil {
+				t.Fatalf("Tx.Set() error = %v", err)
+			}
+		}
+		return tx
+	}
+	visible := func() []bool {
+		var got []bool
+		for _, args := range keys {
+			_, found, _ := Get(args)
+			got = append(got, found)
+		}
+		return got
+	}
+	tempFiles := func() []string {
+		files, _ := filepath.Glob(filepath.Join(cacheFolder, "*.tmp"))
+		return files
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		SetFolder(t.TempDir())
+		tx := stage(t)
+		if got := visible(); !reflect.DeepEqual(got, []bool{false, false, false}) {
+			t.Fatalf("entries visible before Commit: %v", got)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if got := visible(); !reflect.DeepEqual(got, []bool{true, true, true}) {
+			t.Errorf("entries visible after Commit: %v, want all", got)
+		}
+		if files := tempFiles(); len(files) != 0 {
+			t.Errorf("Commit() left temporary files %v", files)
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("second Commit() error = %v, want %v", err, ErrTxDone)
+		}
+	})
+
+	t.Run("rename failure publishes a prefix", func(t *testing.T) {
+		SetFolder(t.TempDir())
+		tx := stage(t)
+
+		renames := 0
+		fs = &FileSystemMock{
+			CreateFunc:     os.Create,
+			OpenFunc:       os.Open,
+			RemoveFunc:     os.Remove,
+			IsNotExistFunc: os.IsNotExist,
+			GlobFunc:       filepath.Glob,
+			RenameFunc: func(oldpath, newpath string) error {
+				renames++
+				if renames == 2 {
+					return errors.New("disk failure")
+				}
+				return os.Rename(oldpath, newpath)
+			},
+		}
+		defer func() { fs = OSFileSystem{} }()
+
+		if err := tx.Commit(); err == nil {
+			t.Fatal("Commit() should return the rename error")
+		}
+		if got := visible(); !reflect.DeepEqual(got, []bool{true, false, false}) {
+			t.Errorf("entries visible after a failed Commit: %v, want only the first", got)
+		}
+		if files := tempFiles(); len(files) != 0 {
+			t.Errorf("Commit() left temporary files %v", files)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		SetFolder(t.TempDir())
+		tx := stage(t)
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("Rollback() error = %v", err)
+		}
+		if got := visible(); !reflect.DeepEqual(got, []bool{false, false, false}) {
+			t.Errorf("entries visible after Rollback: %v", got)
+		}
+		if files := tempFiles(); len(files) != 0 {
+			t.Errorf("Rollback() left temporary files %v", files)
+		}
+		if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+			t.Errorf("Commit() after Rollback error = %v, want %v", err, ErrTxDone)
+		}
+		if err := tx.Set(keys[0], "late", 60); !errors.Is(err, ErrTxDone) {
+			t.Errorf("Set() after Rollback error = %v, want %v", err, ErrTxDone)
+		}
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		SetFolder(t.TempDir())
+		if err := Set(keys[2], "existing", 60); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+		tx := stage(t)
+
+		SetConflictPolicy(Reject)
+		defer SetConflictPolicy(LastWriteWins)
+		if err := tx.Commit(); !errors.Is(err, ErrEntryExists) {
+			t.Fatalf("Commit() error = %v, want %v", err, ErrEntryExists)
+		}
+		if got := visible(); !reflect.DeepEqual(got, []bool{false, false, true}) {
+			t.Errorf("entries visible after a rejected Commit: %v, want only the existing one", got)
+		}
+		if cachedData, _, _ := Get(keys[2]); cachedData != "existing" {
+			t.Errorf("Get() = %v, want the existing entry to be kept", cachedData)
+		}
+		if files := tempFiles(); len(files) != 0 {
+			t.Errorf("Commit() left temporary files %v", files)
+		}
+	})
+}
+
+func TestGetEmptyFile(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "in-flight"}
+	cacheFile := getCacheFileName(HashArgs(args))
+	if err := os.WriteFile(cacheFile, nil, 0o600); err != nil {
+		t.Fatalf("Failed to create empty cache file: %v", err)
+	}
+
+	_, found, err := Get(args)
+	if err != nil {
+		t.Fatalf("Get() error = %v, want no error for an in-flight write", err)
+	}
+	if found {
+		t.Fatal("Get() should treat an empty cache file as a miss")
+	}
+	if _, err := os.Stat(cacheFile); err != nil {
+		t.Errorf("Get() should not remove a recently modified empty cache file: %v", err)
+	}
+
+	stale := time.Now().Add(-2 * inFlightWriteWindow)
+	if err := os.Chtimes(cacheFile, stale, stale); err != nil {
+		t.Fatalf("Failed to age cache file: %v", err)
+	}
+	if _, _, err := Get(args); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if _, err := os.Stat(cacheFile); !os.IsNotExist(err) {
+		t.Errorf("Get() should remove an old empty cache file: %v", err)
+	}
+}
+
+func TestInvalidateToken(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "token"}
+	token, err := SetToken(args, "This is cached data.", 10)
+	if err != nil {
+		t.Fatalf("SetToken() error = %v", err)
+	}
+	if _, found, _ := Get(args); !found {
+		t.Fatal("Get() should find the entry set with SetToken")
+	}
+
+	if err := InvalidateToken(token); err != nil {
+		t.Fatalf("InvalidateToken() error = %v", err)
+	}
+	if _, found, _ := Get(args); found {
+		t.Error("Get() should miss after InvalidateToken")
+	}
+	if err := InvalidateToken(token); err != nil {
+		t.Errorf("InvalidateToken() on a removed entry error = %v", err)
+	}
+
+	for _, token := range []string{"", "../../etc/passwd", "abc"} {
+		if err := InvalidateToken(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("InvalidateToken(%q) error = %v, want %v", token, err, ErrInvalidToken)
+		}
+	}
+}
+
+func TestSetEmbeddedFS(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetEmbeddedFS(nil, "")
+
+	args := []string{"command", "embedded"}
+	cacheItem := CacheItem{
+		Expiration: time.Now().Add(time.Hour),
+		Data:       "baseline data",
+		Created:    time.Now(),
+	}
+	encoded, err := encodeGob(&cacheItem)
+	if err != nil {
+		t.Fatalf("Failed to encode cache item: %v", err)
+	}
+
+	SetEmbeddedFS(fstest.MapFS{
+		"cache/" + cachePrefix + HashArgs(args) + ".gob": &fstest.MapFile{Data: encoded},
+	}, "cache")
+
+	cachedData, found, err := Get(args)
+	if err != nil || !found {
+		t.Fatalf("Get() found = %v, err = %v, want hit from the embedded layer", found, err)
+	}
+	if cachedData != "baseline data" {
+		t.Errorf("Get() = %v, want %v", cachedData, "baseline data")
+	}
+
+	if err := Set(args, "fresh data", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	if cachedData, _, _ := Get(args); cachedData != "fresh data" {
+		t.Errorf("Get() = %v, want the writable layer to take precedence", cachedData)
+	}
+}
+
+func TestProvenanceCache(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+	SetProvenance("fetcher-v1")
+	defer SetProvenance("")
+
+	// Cache keys on flag.Args, which is empty under go test.
+	SetAllowEmptyKey(true)
+	defer SetAllowEmptyKey(false)
+
+	handler := func() (string, error) {
+		return "This is data.", nil
+	}
+	tests := []struct {
+		name  string
+		cache CacheFunc
+		want  string
+	}{
+		{"Cache", Cache, "fetcher-v1"},
+		{"ProvenanceCache", ProvenanceCache("fetcher-v2"), "fetcher-v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cleanup()
+			if _, err := tt.cache(handler); err != nil {
+				t.Fatalf("%s() error = %v", tt.name, err)
+			}
+			e, err := Explain(nil)
+			if err != nil {
+				t.Fatalf("Explain() error = %v", err)
+			}
+			if e.Provenance != tt.want {
+				t.Errorf("%s() provenance = %q, want %q", tt.name, e.Provenance, tt.want)
+			}
+		})
+	}
+}
+
+// updateGolden rewrites the golden files in testdata instead of comparing against them.
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+func TestEntryInfoJSON(t *testing.T) {
+	created := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	entries := []EntryInfo{
+		{
+			Key:        HashArgs([]string{"command", "arg1"}),
+			Expiration: created.Add(5 * time.Minute),
+			Created:    created,
+			Size:       142,
+			Provenance: "fetcher-v2",
+		},
+		{
+			Key:        HashArgs([]string{"command", "baseline"}),
+			Expiration: created.Add(time.Hour),
+			Size:       96,
+			Embedded:   true,
+		},
+	}
+
+	got, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		t.Fatalf("json.MarshalIndent() error = %v", err)
+	}
+	got = append(got, '\n')
+
+	golden := filepath.Join("testdata", "entry_info.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatalf("Failed to update golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("Failed to read golden file: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("EntryInfo JSON changed, run go test -update if intended:\ngot:\n%s\nwant:\n%s", got, want)
+	}
+
+	var decoded []EntryInfo
+	if err := json.Unmarshal(want, &decoded); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("json.Unmarshal() = %+v, want %+v", decoded, entries)
+	}
+}
+
+func TestStreamListEmbedded(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetEmbeddedFS(nil, "")
+	SetFolder(t.TempDir())
+
+	shared := []string{"command", "shared"}
+	baseline := []string{"command", "baseline"}
+	local := []string{"command", "local"}
+
+	embedded := fstest.MapFS{}
+	for _, args := range [][]string{shared, baseline} {
+		encoded, err := encodeGob(&CacheItem{Expiration: time.Now().Add(time.Hour), Data: "baseline data", Provenance: "embedded"})
+		if err != nil {
+			t.Fatalf("Failed to encode cache item: %v", err)
+		}
+		embedded["cache/"+cachePrefix+HashArgs(args)+".gob"] = &fstest.MapFile{Data: encoded}
+	}
+	SetEmbeddedFS(embedded, "cache")
+
+	for _, args := range [][]string{shared, local} {
+		if err := SetWithProvenance(args, "fresh data", 10, "folder"); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+	}
+
+	want := map[string]bool{
+		HashArgs(shared):   false,
+		HashArgs(local):    false,
+		HashArgs(baseline): true,
+	}
+	got := make(map[string]bool)
+	err := StreamList(func(info EntryInfo) error {
+		if _, ok := got[info.Key]; ok {
+			t.Errorf("StreamList() visited entry %s twice", info.Key)
+		}
+		got[info.Key] = info.Embedded
+		if wantProvenance := map[bool]string{false: "folder", true: "embedded"}[info.Embedded]; info.Provenance != wantProvenance {
+			t.Errorf("StreamList() entry %s provenance = %q, want %q", info.Key, info.Provenance, wantProvenance)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamList() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamList() entries = %v, want %v", got, want)
+	}
+
+	entries, next, err := Scan(0, 2)
+	if err != nil || next != 2 || len(entries) != 2 || entries[0].Embedded || entries[1].Embedded {
+		t.Fatalf("Scan(0, 2) = %v, %d, %v, want the two folder entries", entries, next, err)
+	}
+	entries, next, err = Scan(next, 2)
+	if err != nil || next != 0 || len(entries) != 1 || entries[0].Key != HashArgs(baseline) || !entries[0].Embedded {
+		t.Errorf("Scan(2, 2) = %v, %d, %v, want the embedded entry", entries, next, err)
+	}
+}
+
+func TestSetProvenance(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+	SetProvenance("fetcher-v2")
+	defer SetProvenance("")
+
+	if err := Set([]string{"command", "new"}, "new data", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	if err := SetWithProvenance([]string{"command", "legacy"}, "legacy data", 10, "fetcher-v1"); err != nil {
+		t.Fatalf("SetWithProvenance() error = %v", err)
+	}
+
+	got := make(map[string]string)
+	err := StreamList(func(info EntryInfo) error {
+		got[info.Key] = info.Provenance
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamList() error = %v", err)
+	}
+	want := map[string]string{
+		HashArgs([]string{"command", "new"}):    "fetcher-v2",
+		HashArgs([]string{"command", "legacy"}): "fetcher-v1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("StreamList() provenance = %v, want %v", got, want)
+	}
+}
+
+func TestSweepForeignPrefixes(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+
+	if err := Set([]string{"command", "current"}, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	key := HashArgs([]string{"command", "old"})
+	for _, name := range []string{"old_" + key + ".gob", "old_status_" + key + ".gob", "old_notes.gob", "older_" + key + ".gob"} {
+		if err := os.WriteFile(filepath.Join(cacheFolder, name), nil, 0o600); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+	}
+
+	for _, prefixes := range [][]string{{""}, {"old_", "*"}, {"../old_"}} {
+		if _, err := SweepForeignPrefixes(prefixes); !errors.Is(err, ErrInvalidPrefix) {
+			t.Errorf("SweepForeignPrefixes(%q) error = %v, want ErrInvalidPrefix", prefixes, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cacheFolder, "old_"+key+".gob")); err != nil {
+		t.Fatalf("SweepForeignPrefixes() should not remove files when a prefix is invalid: %v", err)
+	}
+
+	removed, err := SweepForeignPrefixes([]string{"old_", "cli_", cachePrefix})
+	if err != nil {
+		t.Fatalf("SweepForeignPrefixes() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("SweepForeignPrefixes() removed = %d, want 2", removed)
+	}
+	if _, found, _ := Get([]string{"command", "current"}); !found {
+		t.Error("SweepForeignPrefixes() should keep entries with the current prefix")
+	}
+	for _, name := range []string{"old_notes.gob", "older_" + key + ".gob"} {
+		if _, err := os.Stat(filepath.Join(cacheFolder, name)); err != nil {
+			t.Errorf("SweepForeignPrefixes() should keep %s: %v", name, err)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	for i := 0; i < 5; i++ {
+		if err := Set([]string{"command", "usage", strconv.Itoa(i)}, "This is cached data.", 10); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+	}
+
+	count, size, err := Usage()
+	if err != nil {
+		t.Fatalf("Usage() error = %v", err)
+	}
+	if count != 5 || size <= 0 {
+		t.Errorf("Usage() = %d, %d, want 5 entries with a positive size", count, size)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				args := []string{"command", "usage", strconv.Itoa(i)}
+				_ = Set(args, "This is cached data.", 10)
+				_, _, _ = Get(args)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				count, _, err := Usage()
+				if err != nil {
+					t.Errorf("Usage() error = %v", err)
+				}
+				if count < 0 || count > 5 {
+					t.Errorf("Usage() count = %d, want between 0 and 5", count)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestListByTTLRange(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	ttls := map[string]int{"long": 86400, "soon-2": 300, "soon-1": 60}
+	for arg, ttl := range ttls {
+		if err := Set([]string{"command", arg}, "This is cached data.", ttl); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+	}
+
+	entries, err := ListByTTLRange(0, 10*time.Minute)
+	if err != nil {
+		t.Fatalf("ListByTTLRange() error = %v", err)
+	}
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Key)
+	}
+	want := []string{HashArgs([]string{"command", "soon-1"}), HashArgs([]string{"command", "soon-2"})}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListByTTLRange() = %v, want %v", got, want)
+	}
+}
+
+func TestExportToMap(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	args := []string{"command", "export"}
+	if err := Set(args, []string{"a", "b"}, 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	if err := Set([]string{"command", "complex"}, complex(1, 2), 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	entries, err := ExportToMap()
+	if err != nil {
+		t.Fatalf("ExportToMap() error = %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("ExportToMap() returned %d entries, want 2", len(entries))
+	}
+
+	encoded, err := json.Marshal(entries[HashArgs(args)].(map[string]interface{})["data"])
+	if err != nil {
+		t.Fatalf("Failed to marshal exported data: %v", err)
+	}
+	if string(encoded) != `["a","b"]` {
+		t.Errorf("ExportToMap() data = %s, want %s", encoded, `["a","b"]`)
+	}
+
+	complexEntry := entries[HashArgs([]string{"command", "complex"})].(map[string]interface{})
+	if complexEntry["data"] != "(1+2i)" {
+		t.Errorf("ExportToMap() data = %v, want the formatted value", complexEntry["data"])
+	}
+}
+
+func TestSwapFolder(t *testing.T) {
+	defer func() { fs = OSFileSystem{} }()
+	defer SetFolder(cacheFolder)
+
+	replaced := []string{"command", "swap", "replaced"}
+	dropped := []string{"command", "swap", "dropped"}
+	added := []string{"command", "swap", "added"}
+
+	tests := []struct {
+		name   string
+		rename func(oldpath, newpath string) error
+	}{
+		{"rename", os.Rename},
+		{"cross-device copy", func(oldpath, newpath string) error {
+			if !strings.HasSuffix(oldpath, ".tmp") {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+			}
+			return os.Rename(oldpath, newpath)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs = OSFileSystem{}
+			active := t.TempDir()
+			staging := filepath.Join(t.TempDir(), "staging")
+			if err := os.Mkdir(staging, 0o700); err != nil {
+				t.Fatalf("Failed to create staging folder: %v", err)
+			}
+
+			SetFolder(active)
+			for _, args := range [][]string{replaced, dropped} {
+				if err := Set(args, "old data", 10); err != nil {
+					t.Fatalf("Failed to set cache: %v", err)
+				}
+			}
+			SetFolder(staging)
+			for _, args := range [][]string{replaced, added} {
+				if err := Set(args, "new data", 10); err != nil {
+					t.Fatalf("Failed to set staging cache: %v", err)
+				}
+			}
+			SetFolder(active)
+
+			fs = &FileSystemMock{
+				CreateFunc:     os.Create,
+				OpenFunc:       os.Open,
+				RemoveFunc:     os.Remove,
+				IsNotExistFunc: os.IsNotExist,
+				GlobFunc:       filepath.Glob,
+				RenameFunc:     tt.rename,
+			}
+			if err := SwapFolder(staging); err != nil {
+				t.Fatalf("SwapFolder() error = %v", err)
+			}
+			fs = OSFileSystem{}
+
+			if cacheFolder != active {
+				t.Errorf("cacheFolder = %s, want the configured folder %s to stay active", cacheFolder, active)
+			}
+			for _, args := range [][]string{replaced, added} {
+				if cachedData, _, _ := Get(args); cachedData != "new data" {
+					t.Errorf("Get(%v) = %v, want new data", args, cachedData)
+				}
+			}
+			if _, found, _ := Get(dropped); found {
+				t.Error("SwapFolder() should remove entries of the previous generation that were not staged")
+			}
+			if files, _ := filepath.Glob(filepath.Join(active, "*.tmp")); len(files) != 0 {
+				t.Errorf("SwapFolder() left temporary files %v", files)
+			}
+			if _, err := os.Stat(staging); !os.IsNotExist(err) {
+				t.Errorf("SwapFolder() should remove the empty staging folder: %v", err)
+			}
+		})
+	}
+
+	if err := SwapFolder(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("SwapFolder() should fail for a missing staging folder")
+	}
+}
+
+func TestSwapFolderPublishFailure(t *testing.T) {
+	defer func() { fs = OSFileSystem{} }()
+	defer SetFolder(cacheFolder)
+
+	fs = OSFileSystem{}
+	active := t.TempDir()
+	staging := t.TempDir()
+	previous := []string{"command", "swap", "previous"}
+
+	SetFolder(active)
+	if err := Set(previous, "old data", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	SetFolder(staging)
+	if err := Set([]string{"command", "swap", "new"}, "new data", 10); err != nil {
+		t.Fatalf("Failed to set staging cache: %v", err)
+	}
+	SetFolder(active)
+
+	fs = &FileSystemMock{
+		CreateFunc:     os.Create,
+		OpenFunc:       os.Open,
+		RemoveFunc:     os.Remove,
+		IsNotExistFunc: os.IsNotExist,
+		GlobFunc:       filepath.Glob,
+		RenameFunc:     func(string, string) error { return errors.New("permission denied") },
+	}
+	if err := SwapFolder(staging); err == nil {
+		t.Fatal("SwapFolder() should return the rename error")
+	}
+	fs = OSFileSystem{}
+
+	if cachedData, _, _ := Get(previous); cachedData != "old data" {
+		t.Errorf("Get() = %v, want the previous generation to be kept after a failed swap", cachedData)
+	}
+}
+
+type registeredStruct struct {
+	Name string
+}
+
+func TestRegisterGobType(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	tests := []struct {
+		name string
+		data interface{}
+	}{
+		{
+			name: "struct",
+			data: registeredStruct{Name: "a"},
+		},
+		{
+			name: "slice",
+			data: []registeredStruct{{Name: "a"}, {Name: "b"}},
+		},
+		{
+			name: "map",
+			data: map[string]int{"a": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RegisterGobType(tt.data)
+			RegisterGobType(tt.data)
+
+			args := []string{"command", "registered", tt.name}
+			if err := Set(args, tt.data, 10); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+			cachedData, found, err := Get(args)
+			if err != nil || !found {
+				t.Fatalf("Get() found = %v, err = %v", found, err)
+			}
+			if !reflect.DeepEqual(cachedData, tt.data) {
+				t.Errorf("Get() = %v, want %v", cachedData, tt.data)
+			}
+
+			name := reflect.TypeOf(tt.data).String()
+			count := 0
+			for _, registered := range RegisteredGobTypes() {
+				if registered == name {
+					count++
+				}
+			}
+			if count != 1 {
+				t.Errorf("RegisteredGobTypes() lists %s %d times, want 1", name, count)
+			}
+		})
+	}
+}
+
+func TestExpiringWithin(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	ttls := map[string]int{"expired": 1, "later": 7200, "second": 1800, "first": 600}
+	for arg, ttl := range ttls {
+		if err := Set([]string{"command", arg}, "This is cached data.", ttl); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	entries, err := ExpiringWithin(time.Hour)
+	if err != nil {
+		t.Fatalf("ExpiringWithin() error = %v", err)
+	}
+
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Key)
+	}
+	want := []string{HashArgs([]string{"command", "first"}), HashArgs([]string{"command", "second"})}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExpiringWithin() = %v, want %v", got, want)
+	}
+}
+
+func TestPruneContext(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+
+	if err := Set([]string{"command", "prune", "live"}, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	// Expired entries are written directly, since Set would clean them up right away.
+	for i := 0; i < 3; i++ {
+		encoded, _ := encodeGob(&CacheItem{Expiration: time.Now().Add(-time.Minute)})
+		cacheFile := getCacheFileName(HashArgs([]string{"command", "prune", strconv.Itoa(i)}))
+		if err := os.WriteFile(cacheFile, encoded, 0o600); err != nil {
+			t.Fatalf("Failed to write expired cache file: %v", err)
+		}
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	removed, err := PruneContext(cancelled)
+	if !errors.Is(err, context.Canceled) || removed != 0 {
+		t.Errorf("PruneContext() = %d, %v, want 0, %v", removed, err, context.Canceled)
+	}
+
+	removed, err = PruneContext(context.Background())
+	if err != nil || removed != 3 {
+		t.Errorf("PruneContext() = %d, %v, want 3, nil", removed, err)
+	}
+
+	removed, err = CleanupContext(cancelled)
+	if !errors.Is(err, context.Canceled) || removed != 0 {
+		t.Errorf("CleanupContext() = %d, %v, want 0, %v", removed, err, context.Canceled)
+	}
+
+	removed, err = CleanupContext(context.Background())
+	if err != nil || removed != 1 {
+		t.Errorf("CleanupContext() = %d, %v, want 1, nil", removed, err)
+	}
+}
+
+func TestSetKeyIgnoreFlags(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetKeyIgnoreFlags(nil)
+
+	SetKeyIgnoreFlags(map[string]bool{"--output-format": true, "--color": false})
+
+	if err := Set([]string{"command", "arg", "--output-format", "json", "--color"}, "This is cached data.", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+
+	for _, args := range [][]string{
+		{"command", "--output-format=yaml", "arg"},
+		{"command", "arg", "--color", "--output-format", "table"},
+	} {
+		if _, found, _ := Get(args); !found {
+			t.Errorf("Get(%v) should hit when only ignored flags differ", args)
+		}
+	}
+
+	if _, found, _ := Get([]string{"command", "--", "--color", "arg"}); found {
+		t.Error("Get() should not strip flags after the -- terminator")
+	}
+
+	if err := Set([]string{"--color", "status"}, "status output", 10); err != nil {
+		t.Fatalf("Failed to set cache: %v", err)
+	}
+	if _, found, _ := Get([]string{"--color", "delete-everything"}); found {
+		t.Error("Get() should miss when a boolean ignored flag is followed by a different argument")
+	}
+}
+
+func TestModify(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "modify"}
+	appendA := func(current interface{}) (interface{}, time.Duration, error) {
+		if current == nil {
+			return "a", time.Minute, nil
+		}
+		return current.(string) + "a", time.Minute, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := Modify(args, appendA); err != nil {
+				t.Errorf("Modify() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if cachedData, _, _ := Get(args); cachedData != "aaaaaaaaaa" {
+		t.Errorf("Get() = %v, want %v", cachedData, "aaaaaaaaaa")
+	}
+
+	failing := errors.New("error")
+	err := Modify(args, func(current interface{}) (interface{}, time.Duration, error) {
+		return nil, 0, failing
+	})
+	if !errors.Is(err, failing) {
+		t.Errorf("Modify() error = %v, want %v", err, failing)
+	}
+	if _, found, _ := Get(args); !found {
+		t.Error("Modify() should leave the entry unchanged when fn fails")
+	}
+
+	err = Modify(args, func(current interface{}) (interface{}, time.Duration, error) {
+		return nil, 0, nil
+	})
+	if err != nil {
+		t.Fatalf("Modify() error = %v", err)
+	}
+	if _, found, _ := Get(args); found {
+		t.Error("Modify() should remove the entry when fn returns nil data")
+	}
+}
+
+func TestForget(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "forget"}
+	other := []string{"command", "other"}
+	for _, a := range [][]string{args, other} {
+		if err := Set(a, "data", 60); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	if err := Forget(context.Background(), args); err != nil {
+		t.Fatalf("Forget() error = %v", err)
+	}
+	if _, found, _ := Get(args); found {
+		t.Error("Forget() should remove the entry")
+	}
+	if _, found, _ := Get(other); !found {
+		t.Error("Forget() should not remove other entries")
+	}
+
+	if err := Forget(context.Background(), args); err != nil {
+		t.Errorf("Forget() of a missing entry error = %v, want nil", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Forget(ctx, other); !errors.Is(err, context.Canceled) {
+		t.Errorf("Forget() error = %v, want %v", err, context.Canceled)
+	}
+
+	ForgetAll()
+	if _, found, _ := Get(other); found {
+		t.Error("ForgetAll() should remove all entries")
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "counter"}
+	const goroutines, delta = 20, 3
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := IncrBy(args, delta, time.Minute); err != nil {
+				t.Errorf("IncrBy() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := IncrBy(args, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("IncrBy() error = %v", err)
+	}
+	if got != goroutines*delta {
+		t.Errorf("IncrBy() = %d, want %d", got, goroutines*delta)
+	}
+
+	if got, _ := IncrBy(args, -goroutines*delta, time.Minute); got != 0 {
+		t.Errorf("IncrBy() = %d, want 0", got)
+	}
+
+	other := []string{"command", "not-a-counter"}
+	if err := Set(other, "text", 60); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, err := IncrBy(other, 1, time.Minute); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("IncrBy() error = %v, want %v", err, ErrTypeMismatch)
+	}
+	if cachedData, _, _ := Get(other); cachedData != "text" {
+		t.Errorf("IncrBy() should leave a mismatched entry unchanged, got %v", cachedData)
+	}
+}
+
+type computeTestUser struct {
+	Name  string
+	Admin bool
+}
+
+func TestGetOrCompute(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	RegisterGobType(computeTestUser{})
+
+	key := []string{"user", "42"}
+	want := computeTestUser{Name: "alice", Admin: true}
+	calls := 0
+	factory := func() (computeTestUser, error) {
+		calls++
+		return want, nil
+	}
+
+	tests := []struct {
+		name    string
+		wantHit bool
+	}{
+		{"miss", false},
+		{"hit", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, hit, err := GetOrCompute(key, 60, factory)
+			if err != nil {
+				t.Fatalf("GetOrCompute() error = %v", err)
+			}
+			if hit != tt.wantHit {
+				t.Errorf("GetOrCompute() hit = %v, want %v", hit, tt.wantHit)
+			}
+			if got != want {
+				t.Errorf("GetOrCompute() = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	if calls != 1 {
+		t.Errorf("factory called %d times, want 1", calls)
+	}
+
+	failing := errors.New("error")
+	_, _, err := GetOrCompute([]string{"user", "43"}, 60, func() (computeTestUser, error) {
+		return computeTestUser{}, failing
+	})
+	if !errors.Is(err, failing) {
+		t.Errorf("GetOrCompute() error = %v, want %v", err, failing)
+	}
+
+	_, _, err = GetOrCompute(key, 60, func() (int, error) {
+		return 0, nil
+	})
+	if !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("GetOrCompute() error = %v, want %v", err, ErrTypeMismatch)
+	}
+	var user computeTestUser
+	if found, err := DecodeAs(key, &user); !found || err != nil {
+		t.Errorf("GetOrCompute() with different type removed the entry: %v", err)
+	}
+}
+
+func TestTTLRules(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetTTLRules(nil)
+
+	SetTTLRules([]TTLRule{
+		{Name: "releases", Prefix: []string{"releases", "list"}, TTL: time.Hour},
+		{Name: "status", Glob: "* status", TTL: 10 * time.Second},
+		{Name: "releases-any", Prefix: []string{"releases"}, TTL: time.Minute},
+	})
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantTTL  time.Duration
+		wantRule string
+	}{
+		{"prefix", []string{"releases", "list", "--all"}, time.Hour, "releases"},
+		{"first match wins", []string{"releases", "show"}, time.Minute, "releases-any"},
+		{"glob", []string{"deploy", "status"}, 10 * time.Second, "status"},
+		{"glob no match", []string{"deploy", "status", "now"}, cacheTTL, ""},
+		{"no match", []string{"other"}, cacheTTL, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, rule := ResolveTTL(tt.args)
+			if ttl != tt.wantTTL || rule != tt.wantRule {
+				t.Errorf("ResolveTTL() = %v, %q, want %v, %q", ttl, rule, tt.wantTTL, tt.wantRule)
+			}
+
+			if err := Set(tt.args, "data", DefaultTTL); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+			var expiration time.Time
+			err := StreamList(func(info EntryInfo) error {
+				if info.Key == generateCacheKey(tt.args) {
+					expiration = info.Expiration
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("StreamList() error = %v", err)
+			}
+			if got := time.Until(expiration); got > tt.wantTTL || got < tt.wantTTL-time.Minute/2 {
+				t.Errorf("Set() with DefaultTTL expires in %v, want about %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDefaultTTLSetters(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+	defer SetTTLDuration(cacheTTL)
+
+	SetTTLDuration(time.Hour)
+
+	tests := []struct {
+		name  string
+		store func(args []string) error
+	}{
+		{"Set", func(args []string) error { return Set(args, "data", DefaultTTL) }},
+		{"SetX", func(args []string) error {
+			_, err := SetX(args, "data", DefaultTTL)
+			return err
+		}},
+		{"SetToken", func(args []string) error {
+			_, err := SetToken(args, "data", DefaultTTL)
+			return err
+		}},
+		{"SetWithProvenance", func(args []string) error { return SetWithProvenance(args, "data", DefaultTTL, "test") }},
+		{"SetWithDeps", func(args []string) error { return SetWithDeps(args, "data", DefaultTTL, nil) }},
+		{"SetWithTTLFunc", func(args []string) error {
+			return SetWithTTLFunc(args, "data", func(interface{}) int { return DefaultTTL })
+		}},
+		{"SetPipeline", func(args []string) error {
+			pipe := NewSetPipeline()
+			pipe.Add(args, "data", DefaultTTL)
+			return pipe.Execute()
+		}},
+		{"Tx", func(args []string) error {
+			tx := Begin()
+			if err := tx.Set(args, "data", DefaultTTL); err != nil {
+				return err
+			}
+			return tx.Commit()
+		}},
+		{"Modify", func(args []string) error {
+			return Modify(args, func(interface{}) (interface{}, time.Duration, error) {
+				return "data", DefaultTTL, nil
+			})
+		}},
+		{"AppendToCache", func(args []string) error { return AppendToCache(args, "data", 0, DefaultTTL) }},
+		{"IncrBy", func(args []string) error {
+			_, err := IncrBy(args, 1, DefaultTTL)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"command", "default-ttl", tt.name}
+			if err := tt.store(args); err != nil {
+				t.Fatalf("%s error = %v", tt.name, err)
+			}
+
+			if _, found, _ := Get(args); !found {
+				t.Fatalf("Get() should hit after %s with DefaultTTL", tt.name)
+			}
+			cacheItem, err := readCacheItem(getCacheFileName(generateCacheKey(args)))
+			if err != nil {
+				t.Fatalf("readCacheItem() error = %v", err)
+			}
+			if got := time.Until(cacheItem.Expiration); got > time.Hour || got < time.Hour-time.Minute {
+				t.Errorf("%s with DefaultTTL expires in %v, want about %v", tt.name, got, time.Hour)
+			}
+		})
+	}
+}
+
+type fakeSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *fakeSpan) End()                                       { s.ended = true }
+
+type fakeTracer struct {
+	spans []*fakeSpan
+}
+
+func (t *fakeTracer) StartSpan(name string) Span {
+	span := &fakeSpan{name: name, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func TestSetTracer(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	tracer := &fakeTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	args := []string{"command", "traced"}
+	key := generateCacheKey(args)
+
+	_, _, _ = Get(args)
+	_ = Set(args, "data", 60)
+	_, _, _ = Get(args)
+
+	want := []struct {
+		name string
+		hit  interface{}
+	}{
+		{"clicache.Get", false},
+		{"clicache.Set", nil},
+		{"clicache.Get", true},
+	}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(tracer.spans), len(want))
+	}
+	for i, w := range want {
+		span := tracer.spans[i]
+		if span.name != w.name {
+			t.Errorf("span %d name = %q, want %q", i, span.name, w.name)
+		}
+		if span.attrs["clicache.key"] != key {
+			t.Errorf("span %d key = %v, want %v", i, span.attrs["clicache.key"], key)
+		}
+		if span.attrs["clicache.hit"] != w.hit {
+			t.Errorf("span %d hit = %v, want %v", i, span.attrs["clicache.hit"], w.hit)
+		}
+		if !span.ended {
+			t.Errorf("span %d was not ended", i)
+		}
+	}
+}
+
+func TestWarnDeprecated(t *testing.T) {
+	var buf strings.Builder
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+	defer ResetDeprecationWarnings()
+	defer SetDeprecationWarnings(true)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    int
+	}{
+		{"enabled", true, 1},
+		{"disabled", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			ResetDeprecationWarnings()
+			SetDeprecationWarnings(tt.enabled)
+
+			for i := 0; i < 3; i++ {
+				warnDeprecated("test-id", "test deprecation")
+			}
+
+			if got := strings.Count(buf.String(), "deprecation=test-id"); got != tt.want {
+				t.Errorf("warnings logged = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForEntry(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	args := []string{"command", "wait"}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = Set(args, "produced", 60)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := WaitForEntry(ctx, args, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WaitForEntry() error = %v", err)
+	}
+	if data != "produced" {
+		t.Errorf("WaitForEntry() = %v, want %v", data, "produced")
+	}
+
+	missing := []string{"command", "never"}
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer timeoutCancel()
+	if _, err := WaitForEntry(timeoutCtx, missing, 10*time.Millisecond); !errors.Is(err, ErrEntryNeverAppeared) {
+		t.Errorf("WaitForEntry() error = %v, want %v", err, ErrEntryNeverAppeared)
+	}
+
+	canceledCtx, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if _, err := WaitForEntry(canceledCtx, missing, 10*time.Millisecond); !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitForEntry() error = %v, want %v", err, context.Canceled)
+	}
+
+	zeroCtx, zeroCancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer zeroCancel()
+	if _, err := WaitForEntry(zeroCtx, missing, 0); !errors.Is(err, ErrEntryNeverAppeared) {
+		t.Errorf("WaitForEntry() with a zero poll interval error = %v, want %v", err, ErrEntryNeverAppeared)
+	}
+}
+
+func TestCacheForFile(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetFileFingerprint(FingerprintContent)
+
+	tests := []struct {
+		name        string
+		fingerprint FileFingerprint
+	}{
+		{"content", FingerprintContent},
+		{"mod time", FingerprintModTime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetFileFingerprint(tt.fingerprint)
+			input := filepath.Join(t.TempDir(), "input.txt")
+			if err := os.WriteFile(input, []byte("one"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			calls := 0
+			handler := func() (interface{}, error) {
+				calls++
+				content, err := os.ReadFile(input)
+				return string(content), err
+			}
+
+			for i := 0; i < 2; i++ {
+				data, err := CacheForFile(input, 60, handler)
+				if err != nil {
+					t.Fatalf("CacheForFile() error = %v", err)
+				}
+				if data != "one" {
+					t.Errorf("CacheForFile() = %v, want %v", data, "one")
+				}
+			}
+			if calls != 1 {
+				t.Errorf("handler called %d times, want 1", calls)
+			}
+
+			if err := os.WriteFile(input, []byte("two!"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			data, err := CacheForFile(input, 60, handler)
+			if err != nil {
+				t.Fatalf("CacheForFile() error = %v", err)
+			}
+			if data != "two!" || calls != 2 {
+				t.Errorf("CacheForFile() = %v after %d calls, want %v after 2", data, calls, "two!")
+			}
+		})
+	}
+
+	_, err := CacheForFile(filepath.Join(t.TempDir(), "missing"), 60, func() (interface{}, error) {
+		return "data", nil
+	})
+	if !os.IsNotExist(err) {
+		t.Errorf("CacheForFile() error = %v, want a not-exist error", err)
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetAllowEmptyKey(false)
+
+	tests := []struct {
+		name    string
+		args    []string
+		allow   bool
+		wantErr error
+	}{
+		{"nil", nil, false, ErrEmptyKey},
+		{"empty", []string{}, false, ErrEmptyKey},
+		{"non-empty", []string{"command"}, false, nil},
+		{"nil allowed", nil, true, nil},
+		{"empty allowed", []string{}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetAllowEmptyKey(tt.allow)
+
+			if err := Set(tt.args, "data", 60); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Set() error = %v, want %v", err, tt.wantErr)
+			}
+			if _, _, err := Get(tt.args); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Get() error = %v, want %v", err, tt.wantErr)
+			}
+			if err := Forget(context.Background(), tt.args); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Forget() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	SetAllowEmptyKey(false)
+	_, err := Cache(func() (string, error) {
+		return "data", nil
+	})
+	if !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Cache() error = %v, want %v", err, ErrEmptyKey)
+	}
+}
+
+func TestSetKeyPrefix(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetKeyPrefix("")
+
+	tests := []struct {
+		name     string
+		prefix   string
+		wantFile string
+	}{
+		{"none", "", "cli_cache_" + HashArgs([]string{"status"}) + ".gob"},
+		{"plain", "status", "cli_cache_status_" + HashArgs([]string{"status"}) + ".gob"},
+		{"sanitized", "st/at us", "cli_cache_st-at-us_" + HashArgs([]string{"status"}) + ".gob"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetKeyPrefix(tt.prefix)
+			args := []string{"status"}
+
+			token, err := SetToken(args, "data", 60)
+			if err != nil {
+				t.Fatalf("SetToken() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(cacheFolder, tt.wantFile)); err != nil {
+				t.Errorf("cache file %s not written: %v", tt.wantFile, err)
+			}
+			if cachedData, found, _ := Get(args); !found || cachedData != "data" {
+				t.Errorf("Get() = %v, %v, want %v, true", cachedData, found, "data")
+			}
+
+			if err := InvalidateToken(token); err != nil {
+				t.Fatalf("InvalidateToken() error = %v", err)
+			}
+			if _, found, _ := Get(args); found {
+				t.Error("InvalidateToken() should remove the prefixed entry")
+			}
+		})
+	}
+
+	if err := InvalidateToken("../etc_" + HashArgs([]string{"x"})); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("InvalidateToken() error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestSetStoreArgs(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	defer SetStoreArgs(false)
+
+	args := []string{"login", "--token", "secret"}
+	for _, enabled := range []bool{false, true} {
+		SetStoreArgs(enabled)
+		if err := Set(args, "data", 60); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+
+		cacheItem, err := readCacheItem(getCacheFileName(generateCacheKey(args)))
+		if err != nil {
+			t.Fatalf("readCacheItem() error = %v", err)
+		}
+		if stored := cacheItem.Args != nil; stored != enabled {
+			t.Errorf("with SetStoreArgs(%v) Args = %v", enabled, cacheItem.Args)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	fs = OSFileSystem{}
+	Cleanup()
+	defer Cleanup()
+	SetStoreArgs(true)
+	defer SetStoreArgs(false)
+
+	entries := map[string][]string{
+		"status":      {"status"},
+		"status-all":  {"status", "--all"},
+		"status-repo": {"status", "repo"},
+		"deploy":      {"deploy", "status"},
+	}
+	for data, args := range entries {
+		if err := Set(args, data, 60); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		prefix []string
+		want   []string
+	}{
+		{"subcommand", []string{"status"}, []string{"status", "status-all", "status-repo"}},
+		{"full args", []string{"status", "repo"}, []string{"status-repo"}},
+		{"no match", []string{"logs"}, nil},
+		{"empty prefix", nil, []string{"deploy", "status", "status-all", "status-repo"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := Query(tt.prefix)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+
+			var got []string
+			for _, r := range results {
+				if r.Key != generateCacheKey(r.Args) {
+					t.Errorf("Query() key %s does not match args %v", r.Key, r.Args)
+				}
+				got = append(got, r.Data.(string))
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+
+	const total = 25
+	for i := 0; i < total; i++ {
+		if err := Set([]string{"scan", strconv.Itoa(i)}, i, 60); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		count     int
+		wantPages int
+	}{
+		{"pages of 10", 10, 3},
+		{"exact pages", 5, 5},
+		{"single page", 100, 1},
+		{"default count", 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			cursor, pages := 0, 0
+			for {
+				entries, next, err := Scan(cursor, tt.count)
+				if err != nil {
+					t.Fatalf("Scan() error = %v", err)
+				}
+				pages++
+				for _, info := range entries {
+					if seen[info.Key] {
+						t.Errorf("Scan() returned %s twice", info.Key)
+					}
+					seen[info.Key] = true
+				}
+				if next == 0 {
+					break
+				}
+				cursor = next
+			}
+
+			if len(seen) != total {
+				t.Errorf("Scan() returned %d entries, want %d", len(seen), total)
+			}
+			if pages != tt.wantPages {
+				t.Errorf("Scan() took %d pages, want %d", pages, tt.wantPages)
+			}
+		})
+	}
+
+	if _, _, err := Scan(-1, 10); err == nil {
+		t.Error("Scan() with a negative cursor should return an error")
+	}
+}
+
+func TestGlobError(t *testing.T) {
+	globErr := errors.New("mount unavailable")
+	fs = &FileSystemMock{
+		GlobFunc: func(pattern string) ([]string, error) {
+			return nil, globErr
+		},
+	}
+	defer func() { fs = OSFileSystem{} }()
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"PruneContext", func() error {
+			_, err := PruneContext(context.Background())
+			return err
+		}},
+		{"CleanupContext", func() error {
+			_, err := CleanupContext(context.Background())
+			return err
+		}},
+		{"CleanupDir", func() error {
+			_, err := CleanupDir(t.TempDir(), "cli_cache_")
+			return err
+		}},
+		{"Usage", func() error {
+			_, _, err := Usage()
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); !errors.Is(err, globErr) {
+				t.Errorf("%s() error = %v, want %v", tt.name, err, globErr)
+			}
+		})
+	}
+}
+
+func TestEntryCount(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+
+	var buf strings.Builder
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	tests := []struct {
+		name        string
+		live        int
+		expired     int
+		wantWarning bool
+	}{
+		{"healthy", 2, 3, false},
+		{"gc lagging", 2, 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Cleanup()
+			buf.Reset()
+
+			for i := 0; i < tt.live; i++ {
+				if err := Set([]string{"count", "live", strconv.Itoa(i)}, i, 60); err != nil {
+					t.Fatalf("Set() error = %v", err)
+				}
+			}
+			// Expired entries are written directly, since Set would clean them up right away.
+			for i := 0; i < tt.expired; i++ {
+				encoded, _ := encodeGob(&CacheItem{Expiration: time.Now().Add(-time.Minute)})
+				cacheFile := getCacheFileName(HashArgs([]string{"count", "expired", strconv.Itoa(i)}))
+				if err := os.WriteFile(cacheFile, encoded, 0o600); err != nil {
+					t.Fatalf("Failed to write expired cache file: %v", err)
+				}
+			}
+
+			live, expired, err := EntryCount()
+			if err != nil {
+				t.Fatalf("EntryCount() error = %v", err)
+			}
+			if live != tt.live || expired != tt.expired {
+				t.Errorf("EntryCount() = %d, %d, want %d, %d", live, expired, tt.live, tt.expired)
+			}
+			if gotWarning := strings.Contains(buf.String(), "not being cleaned up"); gotWarning != tt.wantWarning {
+				t.Errorf("EntryCount() logged warning = %v, want %v", gotWarning, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestSetWithTTLFunc(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+
+	maxAge := func(data interface{}) int {
+		switch data {
+		case "short":
+			return 10
+		case "long":
+			return 3600
+		case "invalid":
+			return -5
+		}
+		return DefaultTTL
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		wantTTL time.Duration
+		wantErr bool
+	}{
+		{"short", "short", 10 * time.Second, false},
+		{"long", "long", time.Hour, false},
+		{"default", "other", cacheTTL, false},
+		{"invalid", "invalid", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"command", "ttlfunc", tt.name}
+			err := SetWithTTLFunc(args, tt.data, maxAge)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetWithTTLFunc() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, found, _ := Get(args); found {
+					t.Error("SetWithTTLFunc() should not store data with an invalid TTL")
+				}
+				return
+			}
+
+			cacheMutex.Lock()
+			_, cacheItem, found, err := getCacheItem(args)
+			cacheMutex.Unlock()
+			if err != nil || !found {
+				t.Fatalf("getCacheItem() = %v, %v", found, err)
+			}
+			if got := time.Until(cacheItem.Expiration); got > tt.wantTTL || got < tt.wantTTL-5*time.Second {
+				t.Errorf("SetWithTTLFunc() expires in %v, want about %v", got, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetMaxAge(0)
+	defer SetDisabled(false)
+
+	args := []string{"command", "explain"}
+	writeItem := func(t *testing.T, item CacheItem) {
+		encoded, err := encodeGob(&item)
+		if err != nil {
+			t.Fatalf("Failed to encode cache item: %v", err)
+		}
+		if err := os.WriteFile(getCacheFileName(HashArgs(args)), encoded, 0o600); err != nil {
+			t.Fatalf("Failed to write cache file: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		args       []string
+		setup      func(t *testing.T)
+		wantReason ExplainReason
+		wantExists bool
+	}{
+		{"hit", args, func(t *testing.T) {
+			_ = Set(args, "data", 60)
+		}, ExplainHit, true},
+		{"not found", args, func(t *testing.T) {}, ExplainNotFound, false},
+		{"empty key", nil, func(t *testing.T) {}, ExplainEmptyKey, false},
+		{"disabled", args, func(t *testing.T) {
+			SetDisabled(true)
+		}, ExplainDisabled, false},
+		{"expired", args, func(t *testing.T) {
+			writeItem(t, CacheItem{Expiration: time.Now().Add(-time.Minute), Data: "data"})
+		}, ExplainExpired, true},
+		{"max age", args, func(t *testing.T) {
+			SetMaxAge(time.Minute)
+			writeItem(t, CacheItem{Expiration: time.Now().Add(time.Hour), Created: time.Now().Add(-time.Hour), Data: "data"})
+		}, ExplainMaxAge, true},
+		{"dependency changed", args, func(t *testing.T) {
+			dep := []string{"command", "dependency"}
+			_ = Set(dep, "dep", 60)
+			_ = SetWithDeps(args, "data", 60, [][]string{dep})
+			_ = Forget(context.Background(), dep)
+		}, ExplainDependencyChanged, true},
+		{"checksum mismatch", args, func(t *testing.T) {
+			var data interface{} = "data"
+			payload, _ := encodeGob(&data)
+			writeItem(t, CacheItem{Expiration: time.Now().Add(time.Hour), Payload: payload, Checksum: "bad"})
+		}, ExplainChecksumMismatch, true},
+		{"unsupported format", args, func(t *testing.T) {
+			writeItem(t, CacheItem{Expiration: time.Now().Add(time.Hour), Format: FormatVersion() + 1})
+		}, ExplainUnsupportedFormat, true},
+		{"write in flight", args, func(t *testing.T) {
+			_ = os.WriteFile(getCacheFileName(HashArgs(args)), nil, 0o600)
+		}, ExplainWriteInFlight, true},
+		{"corrupt", args, func(t *testing.T) {
+			cacheFile := getCacheFileName(HashArgs(args))
+			_ = os.WriteFile(cacheFile, []byte("not a gob stream"), 0o600)
+			old := time.Now().Add(-time.Hour)
+			_ = os.Chtimes(cacheFile, old, old)
+		}, ExplainCorrupt, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetFolder(t.TempDir())
+			SetMaxAge(0)
+			SetDisabled(false)
+			tt.setup(t)
+
+			e, err := Explain(tt.args)
+			if err != nil {
+				t.Fatalf("Explain() error = %v", err)
+			}
+			if e.Reason != tt.wantReason {
+				t.Errorf("Explain() reason = %q, want %q", e.Reason, tt.wantReason)
+			}
+			if e.Exists != tt.wantExists {
+				t.Errorf("Explain() exists = %v, want %v", e.Exists, tt.wantExists)
+			}
+			if e.Key != HashArgs(tt.args) || e.File != getCacheFileName(e.Key) {
+				t.Errorf("Explain() key = %s, file = %s", e.Key, e.File)
+			}
+			if _, err := os.Stat(e.File); (err == nil) != tt.wantExists {
+				t.Errorf("Explain() should not remove the cache file: %v", err)
+			}
+		})
+	}
+
+	SetTTLRules([]TTLRule{{Name: "explain", Prefix: []string{"command"}, TTL: time.Hour}})
+	defer SetTTLRules(nil)
+	if e, _ := Explain(args); e.TTL != time.Hour || e.TTLRule != "explain" {
+		t.Errorf("Explain() TTL = %v, %q, want %v, %q", e.TTL, e.TTLRule, time.Hour, "explain")
+	}
+}
+
+func TestExplainKeyEnv(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetKeyEnv()
+
+	SetKeyEnv("CLICACHE_TEST_SECRET_TOKEN", "CLICACHE_TEST_UNSET")
+	t.Setenv("CLICACHE_TEST_SECRET_TOKEN", "hunter2")
+
+	e, err := Explain([]string{"command", "explain-env"})
+	if err != nil {
+		t.Fatalf("Explain() error = %v", err)
+	}
+
+	want := []KeyEnvVar{{Name: "CLICACHE_TEST_SECRET_TOKEN", Set: true}, {Name: "CLICACHE_TEST_UNSET", Set: false}}
+	if !reflect.DeepEqual(e.KeyEnv, want) {
+		t.Errorf("Explain() KeyEnv = %+v, want %+v", e.KeyEnv, want)
+	}
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if strings.Contains(string(encoded), "hunter2") {
+		t.Errorf("Explain() exposes an environment variable value: %s", encoded)
+	}
+}
+
+func TestPeekMany(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+
+	live := []string{"command", "peek", "live"}
+	expired := []string{"command", "peek", "expired"}
+	missing := []string{"command", "peek", "missing"}
+	if err := Set(live, "data", 60); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	encoded, _ := encodeGob(&CacheItem{Expiration: time.Now().Add(-time.Minute), Data: "old"})
+	expiredFile := getCacheFileName(HashArgs(expired))
+	if err := os.WriteFile(expiredFile, encoded, 0o600); err != nil {
+		t.Fatalf("Failed to write expired cache file: %v", err)
+	}
+	statsBefore := AccessStats()
+
+	results, err := PeekMany([][]string{live, expired, missing})
+	if err != nil {
+		t.Fatalf("PeekMany() error = %v", err)
+	}
+
+	want := []struct {
+		found bool
+		data  interface{}
+	}{
+		{true, "data"},
+		{false, nil},
+		{false, nil},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("PeekMany() returned %d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		if results[i].Found != w.found || results[i].Data != w.data {
+			t.Errorf("PeekMany()[%d] = %v, %v, want %v, %v", i, results[i].Found, results[i].Data, w.found, w.data)
+		}
+	}
+
+	if !reflect.DeepEqual(AccessStats(), statsBefore) {
+		t.Error("PeekMany() should not record access statistics")
+	}
+	if _, err := os.Stat(expiredFile); err != nil {
+		t.Errorf("PeekMany() should not remove expired entries: %v", err)
+	}
+}
+
+func TestPruneAuxiliaryFiles(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+
+	cacheFile := getCacheFileName(HashArgs([]string{"command", "aux"}))
+	stale := cacheFile + ".1-1.tmp"
+	fresh := cacheFile + ".1-2.tmp"
+	unrelated := filepath.Join(cacheFolder, "other.1-1.tmp")
+	old := time.Now().Add(-2 * auxiliaryMaxAge)
+	for _, name := range []string{stale, fresh, unrelated} {
+		if err := os.WriteFile(name, nil, 0o600); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		if name != fresh {
+			if err := os.Chtimes(name, old, old); err != nil {
+				t.Fatalf("Failed to age test file: %v", err)
+			}
+		}
+	}
+
+	stats, err := GC()
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if stats.AuxiliaryRemoved != 1 {
+		t.Errorf("GC() AuxiliaryRemoved = %d, want 1", stats.AuxiliaryRemoved)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("GC() should remove the stale temporary file: %v", err)
+	}
+	for _, name := range []string{fresh, unrelated} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("GC() should keep %s: %v", filepath.Base(name), err)
+		}
+	}
+
+	if err := os.Chtimes(fresh, old, old); err != nil {
+		t.Fatalf("Failed to age test file: %v", err)
+	}
+	Cleanup()
+	if _, err := os.Stat(fresh); !os.IsNotExist(err) {
+		t.Errorf("Cleanup() should remove stale temporary files: %v", err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	SetFolder(t.TempDir())
+
+	if err := Set([]string{"command", "gc", "live"}, "This is cached data.", 60); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	// Expired entries are written directly, since Set would clean them up right away.
+	var freed int64
+	for i := 0; i < 3; i++ {
+		encoded, _ := encodeGob(&CacheItem{Expiration: time.Now().Add(-time.Minute)})
+		cacheFile := getCacheFileName(HashArgs([]string{"command", "gc", strconv.Itoa(i)}))
+		if err := os.WriteFile(cacheFile, encoded, 0o600); err != nil {
+			t.Fatalf("Failed to write expired cache file: %v", err)
+		}
+		freed += int64(len(encoded))
+	}
+
+	stats, err := GC()
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"RemovedCount", stats.RemovedCount, 3},
+		{"TotalScanned", stats.TotalScanned, 4},
+		{"BytesFreed", stats.BytesFreed, freed},
+		{"FirstError", stats.FirstError, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("GC() %s = %v, want %v", tt.name, tt.got, tt.want)
+			}
+		})
+	}
+	if stats.Duration <= 0 {
+		t.Errorf("GC() Duration = %v, want > 0", stats.Duration)
+	}
+	if last := LastGCStats(); last != stats {
+		t.Errorf("LastGCStats() = %+v, want %+v", last, stats)
+	}
+}
+
+func TestComputeKey(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetKeyPrefix("")
+	defer SetKeyIgnoreFlags(nil)
+	defer SetArgCanonicalizer(nil)
+
+	tests := []struct {
+		name  string
+		setup func()
+	}{
+		{"default", func() {}},
+		{"key prefix", func() { SetKeyPrefix("status") }},
+		{"ignored flags", func() { SetKeyIgnoreFlags(map[string]bool{"--color": false}) }},
+		{"canonicalizer", func() { SetArgCanonicalizer(strings.ToLower) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetFolder(t.TempDir())
+			tt.setup()
+
+			args := []string{"Status", "--color", "--all"}
+			if err := Set(args, "data", 60); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+
+			if _, err := os.Stat(getCacheFileName(ComputeKey(args))); err != nil {
+				t.Errorf("ComputeKey() does not match the file written by Set: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadLegacyEntry(t *testing.T) {
+	RegisterGobType(legacygen.User{})
+	created := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		fixture        string
+		wantData       interface{}
+		wantExpiration time.Time
+		wantCreated    time.Time
+		wantArgs       []string
+	}{
+		{"original_string", "This is cached data.", created.Add(time.Hour), time.Time{}, nil},
+		{"string", "This is cached data.", created.Add(5 * time.Minute), created, []string{"command", "arg1"}},
+		{"struct", legacygen.User{Name: "alice", Admin: true}, created.Add(time.Hour), created, []string{"user", "42"}},
+		{"near_expiry", "about to expire", created.Add(time.Second), created, []string{"command", "near-expiry"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "legacy", tt.fixture+".gob"))
+			if err != nil {
+				t.Fatalf("Failed to open fixture: %v", err)
+			}
+			defer f.Close()
+
+			item, err := ReadLegacyEntry(f)
+			if err != nil {
+				t.Fatalf("ReadLegacyEntry() error = %v", err)
+			}
+			if !reflect.DeepEqual(item.Data, tt.wantData) {
+				t.Errorf("ReadLegacyEntry() Data = %#v, want %#v", item.Data, tt.wantData)
+			}
+			if !item.Expiration.Equal(tt.wantExpiration) {
+				t.Errorf("ReadLegacyEntry() Expiration = %v, want %v", item.Expiration, tt.wantExpiration)
+			}
+			if !item.Created.Equal(tt.wantCreated) {
+				t.Errorf("ReadLegacyEntry() Created = %v, want %v", item.Created, tt.wantCreated)
+			}
+			if !reflect.DeepEqual(item.Args, tt.wantArgs) {
+				t.Errorf("ReadLegacyEntry() Args = %v, want %v", item.Args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestFormatVersion(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetChecksum(false)
+	SetFolder(t.TempDir())
+
+	args := []string{"command", "format"}
+	cacheFile := getCacheFileName(HashArgs(args))
+	for _, checksum := range []bool{false, true} {
+		SetChecksum(checksum)
+		if err := Set(args, "data", 60); err != nil {
+			t.Fatalf("Failed to set cache: %v", err)
+		}
+		f, err := os.Open(cacheFile)
+		if err != nil {
+			t.Fatalf("Failed to open cache file: %v", err)
+		}
+		item, err := ReadLegacyEntry(f)
+		_ = f.Close()
+		if err != nil || item.Format != FormatVersion() {
+			t.Errorf("checksum %v: Format = %d, %v, want %d", checksum, item.Format, err, FormatVersion())
+		}
+	}
+
+	// Entries of a newer format are misses, not hits with nil data.
+	encoded, err := encodeGob(&CacheItem{Expiration: time.Now().Add(time.Hour), Format: FormatVersion() + 1})
+	if err != nil {
+		t.Fatalf("Failed to encode cache item: %v", err)
+	}
+	if err := os.WriteFile(cacheFile, encoded, 0o600); err != nil {
+		t.Fatalf("Failed to write cache file: %v", err)
+	}
+	if _, err := ReadLegacyEntry(bytes.NewReader(encoded)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("ReadLegacyEntry() error = %v, want %v", err, ErrUnsupportedFormat)
+	}
+	if data, found, err := Get(args); found || err != nil {
+		t.Errorf("Get() = %v, %v, %v, want a miss", data, found, err)
+	}
+}
+
+func TestCacheWithResult(t *testing.T) {
+	fs = OSFileSystem{}
+	defer Cleanup()
+	// Cache keys on flag.Args, which is empty under go test.
+	SetAllowEmptyKey(true)
+	defer SetAllowEmptyKey(false)
+	defer SetDisabled(false)
+	Cleanup()
+
+	handler := func() (string, error) {
+		return "This is data.", nil
+	}
+
+	tests := []struct {
+		name       string
+		disabled   bool
+		wantSource ResultSource
+	}{
+		{"miss", false, SourceHandler},
+		{"hit", false, SourceCache},
+		{"bypass", true, SourceBypass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetDisabled(tt.disabled)
+
+			result, err := CacheWithResult(handler)
+			if err != nil {
+				t.Fatalf("CacheWithResult() error = %v", err)
+			}
+			if result.Source != tt.wantSource {
+				t.Errorf("CacheWithResult() Source = %v, want %v", result.Source, tt.wantSource)
+			}
+			if result.Data != "This is data." {
+				t.Errorf("CacheWithResult() Data = %v, want %v", result.Data, "This is data.")
+			}
+		})
+	}
+}
+
+func TestModifyConflictPolicy(t *testing.T) {
+	fs = OSFileSystem{}
+	defer SetFolder(cacheFolder)
+	defer SetConflictPolicy(LastWriteWins)
+
+	for _, policy := range []ConflictPolicy{LastWriteWins, FirstWriteWins, Reject} {
+		t.Run(strconv.Itoa(int(policy)), func(t *testing.T) {
+			SetFolder(t.TempDir())
+			SetConflictPolicy(policy)
+
+			counter := []string{"command", "counter"}
+			for want := int64(1); want <= 3; want++ {
+				got, err := IncrBy(counter, 1, time.Minute)
+				if err != nil {
+					t.Fatalf("IncrBy() error = %v", err)
+				}
+				if got != want {
+					t.Errorf("IncrBy() = %d, want %d", got, want)
+				}
+			}
+			if stored, _, _ := Get(counter); stored != int64(3) {
+				t.Errorf("IncrBy() stored %v, want 3", stored)
+			}
+
+			list := []string{"command", "list"}
+			for i := 0; i < 3; i++ {
+				if err := AppendToCache(list, i, 0, time.Minute); err != nil {
+					t.Fatalf("AppendToCache() error = %v", err)
+				}
+			}
+			if items, _, _ := Get(list); !reflect.DeepEqual(items, []interface{}{0, 1, 2}) {
+				t.Errorf("AppendToCache() stored %v, want %v", items, []interface{}{0, 1, 2})
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Package clicachefs provides composable clicache.FileSystem wrappers for testing CLI applications
+// that use clicache, e.g. to inject latency or faults into the cache layer or to count file operations.
+// Install a wrapper with clicache.SetFileSystem.
+package clicachefs
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yarlson/clicache"
+)
+
+// LatencyFS is a clicache.FileSystem that delays every file operation of the wrapped file system.
+type LatencyFS struct {
+	inner clicache.FileSystem
+	delay time.Duration
+}
+
+// NewLatencyFS returns a LatencyFS that sleeps for d before every Create, Open, Remove, Glob and Rename on inner.
+//
+// Example:
+//
+//	clicache.SetFileSystem(clicachefs.NewLatencyFS(clicache.OSFileSystem{}, 50*time.Millisecond))
+func NewLatencyFS(inner clicache.FileSystem, d time.Duration) *LatencyFS {
+	return &LatencyFS{inner: inner, delay: d}
+}
+
+func (l *LatencyFS) Create(name string) (*os.File, error) {
+	time.Sleep(l.delay)
+	return l.inner.Create(name)
+}
+
+func (l *LatencyFS) Open(name string) (*os.File, error) {
+	time.Sleep(l.delay)
+	return l.inner.Open(name)
+}
+
+func (l *LatencyFS) Remove(name string) error {
+	time.Sleep(l.delay)
+	return l.inner.Remove(name)
+}
+
+func (l *LatencyFS) IsNotExist(err error) bool {
+	return l.inner.IsNotExist(err)
+}
+
+func (l *LatencyFS) Glob(pattern string) ([]string, error) {
+	time.Sleep(l.delay)
+	return l.inner.Glob(pattern)
+}
+
+func (l *LatencyFS) Rename(oldpath, newpath string) error {
+	time.Sleep(l.delay)
+	return l.inner.Rename(oldpath, newpath)
+}
+
+// FaultFS is a clicache.FileSystem that fails every n-th file operation of the wrapped file system.
+type FaultFS struct {
+	inner     clicache.FileSystem
+	failEvery int
+	err       error
+
+	mu    sync.Mutex
+	calls int
+}
+
+// NewFaultFS returns a FaultFS that makes every failEvery-th call to Create, Open, Remove, Glob or Rename return
+// err instead of calling inner. A failEvery of zero or less never fails.
+//
+// Example:
+//
+//	clicache.SetFileSystem(clicachefs.NewFaultFS(clicache.OSFileSystem{}, 3, syscall.EIO))
+func NewFaultFS(inner clicache.FileSystem, failEvery int, err error) *FaultFS {
+	return &FaultFS{inner: inner, failEvery: failEvery, err: err}
+}
+
+// fail reports whether the current call should fail.
+func (f *FaultFS) fail() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls++
+	return f.failEvery > 0 && f.calls%f.failEvery == 0
+}
+
+func (f *FaultFS) Create(name string) (*os.File, error) {
+	if f.fail() {
+		return nil, f.err
+	}
+	return f.inner.Create(name)
+}
+
+func (f *FaultFS) Open(name string) (*os.File, error) {
+	if f.fail() {
+		return nil, f.err
+	}
+	return f.inner.Open(name)
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if f.fail() {
+		return f.err
+	}
+	return f.inner.Remove(name)
+}
+
+func (f *FaultFS) IsNotExist(err error) bool {
+	return f.inner.IsNotExist(err)
+}
+
+func (f *FaultFS) Glob(pattern string) ([]string, error) {
+	if f.fail() {
+		return nil, f.err
+	}
+	return f.inner.Glob(pattern)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if f.fail() {
+		return f.err
+	}
+	return f.inner.Rename(oldpath, newpath)
+}
+
+// CountingFS is a clicache.FileSystem that counts the calls to each method of the wrapped file system.
+type CountingFS struct {
+	inner clicache.FileSystem
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewCountingFS returns a CountingFS wrapping inner.
+//
+// Example:
+//
+//	counting := clicachefs.NewCountingFS(clicache.OSFileSystem{})
+//	clicache.SetFileSystem(counting)
+//	// ...
+//	fmt.Println(counting.Calls("Open"))
+func NewCountingFS(inner clicache.FileSystem) *CountingFS {
+	return &CountingFS{inner: inner, counts: make(map[string]int)}
+}
+
+// Calls returns the number of calls made to the named method, e.g. "Open".
+func (c *CountingFS) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.counts[method]
+}
+
+// count records a call to the named method.
+func (c *CountingFS) count(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[method]++
+}
+
+func (c *CountingFS) Create(name string) (*os.File, error) {
+	c.count("Create")
+	return c.inner.Create(name)
+}
+
+func (c *CountingFS) Open(name string) (*os.File, error) {
+	c.count("Open")
+	return c.inner.Open(name)
+}
+
+func (c *CountingFS) Remove(name string) error {
+	c.count("Remove")
+	return c.inner.Remove(name)
+}
+
+func (c *CountingFS) IsNotExist(err error) bool {
+	c.count("IsNotExist")
+	return c.inner.IsNotExist(err)
+}
+
+func (c *CountingFS) Glob(pattern string) ([]string, error) {
+	c.count("Glob")
+	return c.inner.Glob(pattern)
+}
+
+func (c *CountingFS) Rename(oldpath, newpath string) error {
+	c.count("Rename")
+	return c.inner.Rename(oldpath, newpath)
+}
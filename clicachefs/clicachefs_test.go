@@ -0,0 +1,66 @@
+package clicachefs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yarlson/clicache"
+)
+
+// useTempFolder points the cache at a temporary folder for the duration of the test, so these tests
+// don't interfere with the clicache package's tests running in parallel.
+func useTempFolder(t *testing.T) {
+	t.Helper()
+
+	clicache.SetFolder(t.TempDir())
+	t.Cleanup(func() { clicache.SetFolder("/tmp/") })
+}
+
+func TestLatencyFS(t *testing.T) {
+	useTempFolder(t)
+	defer clicache.SetFileSystem(nil)
+	clicache.SetFileSystem(NewLatencyFS(clicache.OSFileSystem{}, 20*time.Millisecond))
+
+	start := time.Now()
+	if _, _, err := clicache.Get([]string{"clicachefs", "latency"}); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Get() took %v, want at least %v", elapsed, 20*time.Millisecond)
+	}
+}
+
+func TestFaultFS(t *testing.T) {
+	useTempFolder(t)
+	defer clicache.SetFileSystem(nil)
+	injected := errors.New("injected I/O error")
+	clicache.SetFileSystem(NewFaultFS(clicache.OSFileSystem{}, 1, injected))
+
+	err := clicache.Set([]string{"clicachefs", "fault"}, "This is cached data.", 10)
+	if !errors.Is(err, injected) {
+		t.Errorf("Set() error = %v, want %v", err, injected)
+	}
+}
+
+func TestCountingFS(t *testing.T) {
+	useTempFolder(t)
+	defer clicache.SetFileSystem(nil)
+	counting := NewCountingFS(clicache.OSFileSystem{})
+	clicache.SetFileSystem(counting)
+
+	args := []string{"clicachefs", "counting"}
+	if err := clicache.Set(args, "This is cached data.", 10); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if _, _, err := clicache.Get(args); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if got := counting.Calls("Create"); got != 1 {
+		t.Errorf("Calls(Create) = %d, want 1", got)
+	}
+	if got := counting.Calls("Open"); got < 1 {
+		t.Errorf("Calls(Open) = %d, want at least 1", got)
+	}
+}
@@ -0,0 +1,18 @@
+// Command clicache-hash prints the clicache cache key for the given arguments.
+// It lets shell scripts and Makefiles locate cache entries without running the Go program.
+//
+// Usage:
+//
+//	clicache-hash command arg1 arg2
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/yarlson/clicache"
+)
+
+func main() {
+	fmt.Println(clicache.HashArgs(os.Args[1:]))
+}
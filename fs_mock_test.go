@@ -17,6 +17,9 @@ import (
 //			CreateFunc: func(name string) (*os.File, error) {
 //				panic("mock out the Create method")
 //			},
+//			GlobFunc: func(pattern string) ([]string, error) {
+//				panic("mock out the Glob method")
+//			},
 //			IsNotExistFunc: func(err error) bool {
 //				panic("mock out the IsNotExist method")
 //			},
@@ -26,6 +29,9 @@ import (
 //			RemoveFunc: func(name string) error {
 //				panic("mock out the Remove method")
 //			},
+//			RenameFunc: func(oldpath string, newpath string) error {
+//				panic("mock out the Rename method")
+//			},
 //		}
 //
 //		// use mockedFileSystem in code that requires FileSystem
@@ -36,6 +42,9 @@ type FileSystemMock struct {
 	// CreateFunc mocks the Create method.
 	CreateFunc func(name string) (*os.File, error)
 
+	// GlobFunc mocks the Glob method.
+	GlobFunc func(pattern string) ([]string, error)
+
 	// IsNotExistFunc mocks the IsNotExist method.
 	IsNotExistFunc func(err error) bool
 
@@ -45,6 +54,9 @@ type FileSystemMock struct {
 	// RemoveFunc mocks the Remove method.
 	RemoveFunc func(name string) error
 
+	// RenameFunc mocks the Rename method.
+	RenameFunc func(oldpath string, newpath string) error
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Create holds details about calls to the Create method.
@@ -52,6 +64,11 @@ type FileSystemMock struct {
 			// Name is the name argument value.
 			Name string
 		}
+		// Glob holds details about calls to the Glob method.
+		Glob []struct {
+			// Pattern is the pattern argument value.
+			Pattern string
+		}
 		// IsNotExist holds details about calls to the IsNotExist method.
 		IsNotExist []struct {
 			// Err is the err argument value.
@@ -67,11 +84,20 @@ type FileSystemMock struct {
 			// Name is the name argument value.
 			Name string
 		}
+		// Rename holds details about calls to the Rename method.
+		Rename []struct {
+			// Oldpath is the oldpath argument value.
+			Oldpath string
+			// Newpath is the newpath argument value.
+			Newpath string
+		}
 	}
 	lockCreate     sync.RWMutex
+	lockGlob       sync.RWMutex
 	lockIsNotExist sync.RWMutex
 	lockOpen       sync.RWMutex
 	lockRemove     sync.RWMutex
+	lockRename     sync.RWMutex
 }
 
 // Create calls CreateFunc.
@@ -106,6 +132,38 @@ func (mock *FileSystemMock) CreateCalls() []struct {
 	return calls
 }
 
+// Glob calls GlobFunc.
+func (mock *FileSystemMock) Glob(pattern string) ([]string, error) {
+	if mock.GlobFunc == nil {
+		panic("FileSystemMock.GlobFunc: method is nil but FileSystem.Glob was just called")
+	}
+	callInfo := struct {
+		Pattern string
+	}{
+		Pattern: pattern,
+	}
+	mock.lockGlob.Lock()
+	mock.calls.Glob = append(mock.calls.Glob, callInfo)
+	mock.lockGlob.Unlock()
+	return mock.GlobFunc(pattern)
+}
+
+// GlobCalls gets all the calls that were made to Glob.
+// Check the length with:
+//
+//	len(mockedFileSystem.GlobCalls())
+func (mock *FileSystemMock) GlobCalls() []struct {
+	Pattern string
+} {
+	var calls []struct {
+		Pattern string
+	}
+	mock.lockGlob.RLock()
+	calls = mock.calls.Glob
+	mock.lockGlob.RUnlock()
+	return calls
+}
+
 // IsNotExist calls IsNotExistFunc.
 func (mock *FileSystemMock) IsNotExist(err error) bool {
 	if mock.IsNotExistFunc == nil {
@@ -201,3 +259,39 @@ func (mock *FileSystemMock) RemoveCalls() []struct {
 	mock.lockRemove.RUnlock()
 	return calls
 }
+
+// Rename calls RenameFunc.
+func (mock *FileSystemMock) Rename(oldpath string, newpath string) error {
+	if mock.RenameFunc == nil {
+		panic("FileSystemMock.RenameFunc: method is nil but FileSystem.Rename was just called")
+	}
+	callInfo := struct {
+		Oldpath string
+		Newpath string
+	}{
+		Oldpath: oldpath,
+		Newpath: newpath,
+	}
+	mock.lockRename.Lock()
+	mock.calls.Rename = append(mock.calls.Rename, callInfo)
+	mock.lockRename.Unlock()
+	return mock.RenameFunc(oldpath, newpath)
+}
+
+// RenameCalls gets all the calls that were made to Rename.
+// Check the length with:
+//
+//	len(mockedFileSystem.RenameCalls())
+func (mock *FileSystemMock) RenameCalls() []struct {
+	Oldpath string
+	Newpath string
+} {
+	var calls []struct {
+		Oldpath string
+		Newpath string
+	}
+	mock.lockRename.RLock()
+	calls = mock.calls.Rename
+	mock.lockRename.RUnlock()
+	return calls
+}
@@ -1,3 +1,5 @@
 module github.com/yarlson/clicache
 
 go 1.21.1
+
+require golang.org/x/time v0.5.0
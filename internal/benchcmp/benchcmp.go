@@ -0,0 +1,111 @@
+// Package benchcmp compares benchmark results against the baseline in testdata/bench_baseline.txt,
+// so that performance regressions in the hot paths are caught before release. Results are compared
+// by the median ns/op of each benchmark; the GOMAXPROCS suffix of benchmark names is ignored.
+// Timings depend on the machine, so record the baseline on the machine that runs the comparison.
+//
+// Compare the current tree with the baseline from the repository root with:
+//
+//	go test -run '^$' -bench . -count 5 . > bench_output.txt
+//	go run ./internal/benchcmp/cmp.go testdata/bench_baseline.txt bench_output.txt
+//
+// Update the baseline after an intended performance change with:
+//
+//	go test -run '^$' -bench . -count 5 . > testdata/bench_baseline.txt
+package benchcmp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// procsSuffix matches the GOMAXPROCS suffix that go test appends to benchmark names.
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// Regression is a benchmark that got slower than the baseline allows.
+type Regression struct {
+	Name     string
+	Baseline float64
+	Current  float64
+}
+
+// Delta returns the relative change of the ns/op value, e.g. 0.25 for 25% slower.
+func (r Regression) Delta() float64 {
+	return r.Current/r.Baseline - 1
+}
+
+// Parse reads go test -bench output and returns the median ns/op value of each benchmark.
+// Lines that are not benchmark results are ignored.
+//
+// Returns an error if a benchmark result has a malformed ns/op value or reading fails.
+func Parse(r io.Reader) (map[string]float64, error) {
+	samples := make(map[string][]float64)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+
+		for i := 2; i+1 < len(fields); i++ {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+
+			value, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("benchcmp: invalid ns/op value in %q: %w", scanner.Text(), err)
+			}
+			name := procsSuffix.ReplaceAllString(fields[0], "")
+			samples[name] = append(samples[name], value)
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]float64, len(samples))
+	for name, values := range samples {
+		results[name] = median(values)
+	}
+
+	return results, nil
+}
+
+// median returns the median of values, which must not be empty.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2
+	}
+	return values[mid]
+}
+
+// Compare returns the benchmarks whose current ns/op value exceeds the baseline by more than
+// threshold, e.g. 0.2 for 20%, sorted by name. Benchmarks missing from either result are skipped.
+func Compare(baseline, current map[string]float64, threshold float64) []Regression {
+	var regressions []Regression
+	for name, base := range baseline {
+		cur, ok := current[name]
+		if !ok || base <= 0 {
+			continue
+		}
+
+		if r := (Regression{Name: name, Baseline: base, Current: cur}); r.Delta() > threshold {
+			regressions = append(regressions, r)
+		}
+	}
+
+	sort.Slice(regressions, func(i, j int) bool {
+		return regressions[i].Name < regressions[j].Name
+	})
+
+	return regressions
+}
@@ -0,0 +1,47 @@
+package benchcmp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	output := `goos: linux
+BenchmarkSet/1024-8     	    9453	    100 ns/op	   9.11 MB/s
+BenchmarkSet/1024-8     	    9522	    300 ns/op	   7.59 MB/s
+BenchmarkSet/1024-8     	    8108	    200 ns/op	   7.91 MB/s
+BenchmarkGetMiss        	  243162	     50 ns/op
+PASS
+`
+	results, err := Parse(strings.NewReader(output))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	want := map[string]float64{"BenchmarkSet/1024": 200, "BenchmarkGetMiss": 50}
+	if len(results) != len(want) {
+		t.Fatalf("Parse() = %v, want %v", results, want)
+	}
+	for name, value := range want {
+		if results[name] != value {
+			t.Errorf("Parse()[%s] = %v, want %v", name, results[name], value)
+		}
+	}
+
+	if _, err := Parse(strings.NewReader("BenchmarkSet 10 abc ns/op\n")); err == nil {
+		t.Error("Parse() should return an error for a malformed ns/op value")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	baseline := map[string]float64{"BenchmarkA": 100, "BenchmarkB": 100, "BenchmarkC": 100, "BenchmarkRemoved": 100}
+	current := map[string]float64{"BenchmarkA": 119, "BenchmarkB": 150, "BenchmarkC": 50, "BenchmarkNew": 100}
+
+	regressions := Compare(baseline, current, 0.2)
+	if len(regressions) != 1 || regressions[0].Name != "BenchmarkB" {
+		t.Fatalf("Compare() = %v, want only BenchmarkB", regressions)
+	}
+	if delta := regressions[0].Delta(); delta != 0.5 {
+		t.Errorf("Delta() = %v, want 0.5", delta)
+	}
+}
@@ -0,0 +1,56 @@
+//go:build ignore
+
+// cmp compares benchmark output with a baseline and exits with status 1 if a benchmark regressed.
+//
+// Usage:
+//
+//	go run ./internal/benchcmp/cmp.go [-threshold 0.2] baseline.txt current.txt
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/yarlson/clicache/internal/benchcmp"
+)
+
+func main() {
+	threshold := flag.Float64("threshold", 0.2, "allowed slowdown relative to the baseline, e.g. 0.2 for 20%")
+	flag.Parse()
+	if flag.NArg() != 2 {
+		log.Fatal("usage: go run ./internal/benchcmp/cmp.go [-threshold 0.2] baseline.txt current.txt")
+	}
+
+	baseline := parseFile(flag.Arg(0))
+	current := parseFile(flag.Arg(1))
+
+	regressions := benchcmp.Compare(baseline, current, *threshold)
+	for _, r := range regressions {
+		fmt.Printf("%s: %.0f ns/op -> %.0f ns/op (%+.1f%%)\n", r.Name, r.Baseline, r.Current, r.Delta()*100)
+	}
+	if len(regressions) > 0 {
+		os.Exit(1)
+	}
+
+	fmt.Printf("no regressions over %.0f%% in %d benchmarks\n", *threshold*100, len(current))
+}
+
+func parseFile(name string) map[string]float64 {
+	file, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+
+	results, err := benchcmp.Parse(file)
+	if err != nil {
+		log.Fatalf("parse %s: %v", name, err)
+	}
+	if len(results) == 0 {
+		log.Fatalf("parse %s: no benchmark results", name)
+	}
+
+	return results
+}
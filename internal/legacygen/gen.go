@@ -0,0 +1,29 @@
+//go:build ignore
+
+// gen writes the legacy cache entry fixtures to testdata/legacy.
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/yarlson/clicache/internal/legacygen"
+)
+
+func main() {
+	dir := filepath.Join("testdata", "legacy")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, fixture := range legacygen.Fixtures() {
+		encoded, err := legacygen.Encode(fixture.Item)
+		if err != nil {
+			log.Fatalf("encode %s: %v", fixture.Name, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fixture.Name+".gob"), encoded, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
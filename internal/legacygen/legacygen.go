@@ -0,0 +1,85 @@
+// Package legacygen defines the legacy cache entry fixtures in testdata/legacy. The fixtures are
+// encoded with copies of the cache item layouts written by released versions of clicache, so that
+// tests keep proving those entries can still be read after the format changes.
+//
+// Regenerate the fixtures from the repository root with:
+//
+//	go run ./internal/legacygen/gen.go
+package legacygen
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+)
+
+// User is a struct cached as interface{} data, which requires gob registration.
+type User struct {
+	Name  string
+	Admin bool
+}
+
+// CacheItem mirrors the cache item layout written by Set. Fields that Set leaves zero are
+// omitted from the gob stream, so the same layout also produces entries of older versions.
+type CacheItem struct {
+	Expiration time.Time
+	Data       interface{}
+	Created    time.Time
+	Args       []string
+}
+
+// Fixture is a legacy cache entry stored as testdata/legacy/<Name>.gob.
+type Fixture struct {
+	Name string
+	Item CacheItem
+}
+
+// created is the fixed creation time of all fixtures.
+var created = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// Fixtures returns the legacy cache entry fixtures.
+func Fixtures() []Fixture {
+	return []Fixture{
+		{
+			// Entries of the first releases only stored the expiration and the data.
+			Name: "original_string",
+			Item: CacheItem{Expiration: created.Add(time.Hour), Data: "This is cached data."},
+		},
+		{
+			Name: "string",
+			Item: CacheItem{
+				Expiration: created.Add(5 * time.Minute),
+				Data:       "This is cached data.",
+				Created:    created,
+				Args:       []string{"command", "arg1"},
+			},
+		},
+		{
+			Name: "struct",
+			Item: CacheItem{
+				Expiration: created.Add(time.Hour),
+				Data:       User{Name: "alice", Admin: true},
+				Created:    created,
+				Args:       []string{"user", "42"},
+			},
+		},
+		{
+			Name: "near_expiry",
+			Item: CacheItem{
+				Expiration: created.Add(time.Second),
+				Data:       "about to expire",
+				Created:    created,
+				Args:       []string{"command", "near-expiry"},
+			},
+		},
+	}
+}
+
+// Encode encodes the cache item the way Set writes it to a cache file.
+func Encode(item CacheItem) ([]byte, error) {
+	gob.Register(User{})
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(&item)
+	return buf.Bytes(), err
+}